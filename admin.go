@@ -0,0 +1,144 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "log"
+  "net/http"
+  "os"
+  "os/signal"
+  "strings"
+  "syscall"
+)
+
+type admin_result struct{
+  Operation string `json:"operation"`
+  Ok bool `json:"ok"`
+  Error string `json:"error,omitempty"`
+  DailyFile string `json:"daily_file"`
+  MonthlyFile string `json:"monthly_file"`
+}
+
+// Write the current counters to disk
+func do_flush() error {
+  slock.Lock()
+  wlock.Lock()
+  defer wlock.Unlock()
+  defer slock.Unlock()
+  err := flush_json_to_disk()
+  if err == nil {
+    WCOUNTER = 0
+  }
+  return err
+}
+
+// Close the current day now, as a rollover would, and count on from what
+// was flushed
+func do_rotate() error {
+  slock.Lock()
+  wlock.Lock()
+  defer wlock.Unlock()
+  defer slock.Unlock()
+  return switch_period(period_now(), true)
+}
+
+// Re-read the config file and the GeoIP database
+func do_reload() error {
+  slock.Lock()
+  wlock.Lock()
+  defer wlock.Unlock()
+  defer slock.Unlock()
+  old, oldloc, oldrules := CONFIG, LOCATION, BUCKET_RULES
+  if err := load_config(); err != nil {
+    return err
+  }
+  if err := load_geoip(); err != nil {
+    // Keep running with the old settings and database
+    CONFIG, LOCATION, BUCKET_RULES = old, oldloc, oldrules
+    return err
+  }
+  if err := AGGREGATOR.SetConfig(aggregator_config()); err != nil {
+    CONFIG, LOCATION, BUCKET_RULES = old, oldloc, oldrules
+    return err
+  }
+  // The timezone may have moved the period boundary
+  return get_daily_filename()
+}
+
+func run_admin_op(op string) admin_result {
+  var err error
+  switch op {
+    case "flush":
+      err = do_flush()
+    case "rotate":
+      err = do_rotate()
+    case "reload":
+      err = do_reload()
+  }
+  res := admin_result{Operation: op, Ok: err == nil}
+  if err != nil {
+    res.Error = err.Error()
+    log.Println("Admin", op, "failed:", err)
+  } else {
+    log.Println("Admin", op, "completed")
+  }
+  slock.Lock()
+  res.DailyFile = DAILYFILE
+  res.MonthlyFile = MONTHLYFILE
+  slock.Unlock()
+  return res
+}
+
+// Check the bearer token against the configured admin token
+func admin_authorized(req *http.Request) bool {
+  wlock.RLock()
+  token := CONFIG.AdminToken
+  wlock.RUnlock()
+  if token == "" { return false }
+  auth := req.Header.Get("Authorization")
+  if !strings.HasPrefix(auth, "Bearer ") { return false }
+  given := strings.TrimPrefix(auth, "Bearer ")
+  return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// POST /admin/{flush,rotate,reload}
+func admin(rw http.ResponseWriter, req *http.Request) {
+  if !admin_authorized(req) {
+    http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+    return
+  }
+  if req.Method != http.MethodPost {
+    http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  op := strings.TrimPrefix(req.URL.Path, "/admin/")
+  if op != "flush" && op != "rotate" && op != "reload" {
+    http.NotFound(rw, req)
+    return
+  }
+  res := run_admin_op(op)
+  rw.Header().Set("Content-Type", "application/json")
+  if !res.Ok { rw.WriteHeader(http.StatusInternalServerError) }
+  json.NewEncoder(rw).Encode(res)
+}
+
+// SIGHUP reloads, SIGUSR1 flushes
+func control_signals() {
+  defer WORKERS.Done()
+  sigs := make(chan os.Signal, 1)
+  signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR1)
+  defer signal.Stop(sigs)
+  for {
+    select {
+    case <-STOP:
+      return
+    case sig := <-sigs:
+      switch sig {
+        case syscall.SIGHUP:
+          run_admin_op("reload")
+        case syscall.SIGUSR1:
+          run_admin_op("flush")
+      }
+    }
+  }
+}
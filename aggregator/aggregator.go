@@ -0,0 +1,206 @@
+// Package aggregator counts usage submissions into the daily (per segment)
+// and monthly stats the collector stores. It holds no global state, so any
+// number of aggregators can run side by side in one process.
+package aggregator
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net"
+  "time"
+)
+
+// Segments every day is split into ("" is all submissions)
+var Segments = []string{"", "CORE", "ENTERPRISE", "SCALE", "INTERNAL"}
+
+// Settings used while counting
+type Config struct{
+  // Bucketing rules for numeric fields, checked before the defaults
+  BucketRules []BucketRule
+  // Field allow / deny lists, scrubbing and hashing
+  Policy Policy
+  // Caps on the number of distinct string values kept per path
+  Cardinality []CardinalityRule
+  // How the elements of each array of objects are keyed
+  ArrayKeys []ArrayKeyRule
+  // Pairs of dimensions counted against each other
+  Crosstabs []CrosstabRule
+  // Where oddities in a submission (an unknown platform, a value of an
+  // unexpected type) are reported, nil to drop them
+  Logf func(format string, v ...interface{})
+}
+
+func (C *Config) logf(format string, v ...interface{}) {
+  if C.Logf != nil { C.Logf(format, v...) }
+}
+
+// Where a submission came from
+type Meta struct{
+  // GeoIP country code, "" if unknown
+  Country string
+  // Client address, private or empty addresses count as INTERNAL
+  IP string
+}
+
+// Counters for one day (split by segment) and the month it is in
+type Aggregator struct{
+  config Config
+  Daily map[string]Output `json:"daily"`
+  DailyIDs map[string]bool `json:"daily_ids"`
+  Month Output `json:"month"`
+  MonthIDs map[string]bool `json:"month_ids"`
+}
+
+// New empty aggregator. The policy's scrub patterns are compiled here, so
+// a bad pattern is an error.
+func New(config Config) (*Aggregator, error) {
+  A := &Aggregator{}
+  if err := A.SetConfig(config); err != nil {
+    return nil, err
+  }
+  A.Reset()
+  return A, nil
+}
+
+// Swap in new settings, counters already added are left alone
+func (A *Aggregator) SetConfig(config Config) error {
+  policy, err := CompilePolicy(config.Policy)
+  if err != nil { return err }
+  config.Policy = policy
+  A.config = config
+  return nil
+}
+
+func empty_output() Output {
+  return Output{Country: make(map[string]float64)}
+}
+
+// Clear the daily and monthly counters
+func (A *Aggregator) Reset() {
+  A.ResetDay()
+  A.ResetMonth()
+}
+
+// Clear the daily counters, at the start of a new day
+func (A *Aggregator) ResetDay() {
+  A.Daily = make(map[string]Output)
+  for _, segment := range(Segments) {
+    A.Daily[segment] = empty_output()
+  }
+  A.DailyIDs = make(map[string]bool)
+}
+
+// Clear the monthly counters, at the start of a new month
+func (A *Aggregator) ResetMonth() {
+  A.Month = empty_output()
+  A.MonthIDs = make(map[string]bool)
+}
+
+func privateIP(ip string) (bool, error) {
+    var err error
+    private := false
+    IP := net.ParseIP(ip)
+    if IP == nil {
+        err = errors.New("Invalid IP")
+    } else {
+        _, private24BitBlock, _ := net.ParseCIDR("10.0.0.0/8")
+        _, private20BitBlock, _ := net.ParseCIDR("172.16.0.0/12")
+        _, private16BitBlock, _ := net.ParseCIDR("192.168.0.0/16")
+        private = private24BitBlock.Contains(IP) || private20BitBlock.Contains(IP) || private16BitBlock.Contains(IP)
+    }
+    return private, err
+}
+
+// Segment a submission is counted in besides "": INTERNAL when it comes
+// from a private (or unknown) address, else the one for its platform, or
+// "" for a platform we don't know
+func Segment(platform string, ip string) string {
+  // If this is coming in via an internal IP address, lets toss those into their own file
+  isPrivate, _ := privateIP(ip)
+  if ( isPrivate || ip == "" ) {
+    return "INTERNAL"
+  }
+  switch platform {
+    case "FreeNAS", "TrueNAS-CORE":
+      return "CORE"
+    case "TrueNAS", "TrueNAS-Enterprise", "TrueNAS-ENTERPRISE":
+      return "ENTERPRISE"
+    case "TrueNAS-SCALE":
+      return "SCALE"
+  }
+  return ""
+}
+
+// Count one decoded submission (decode with UseNumber so large byte
+// counts stay exact)
+func (A *Aggregator) Add(inputs map[string]interface{}, meta Meta) error {
+  C := &A.config
+  geolocation, ip := meta.Country, meta.IP
+  //First verify that the system was not already counted
+  id := ""
+  if tmp, ok := inputs["system_hash"].(string) ; ok {
+    id = tmp
+  }
+  if ( id == "" ) {
+    return errors.New("Empty ID")
+  }
+  // DAILY STATS OBJECT
+
+  // Convert ID into ID + IP
+  t := time.Now()
+  id = id + "-" + ip + "-" + t.String()
+
+  // Locate the platform key
+  platform := fmt.Sprintf("%v", inputs["platform"])
+
+  // Drop / scrub anything the policy doesn't want counted
+  redactions := make(map[string]float64)
+  inputs = C.apply_policy(inputs, redactions)
+
+  // Add to the combined JSON object
+  A.DailyIDs[id] = true
+  A.Daily[""] = C.addToJsonObject(A.Daily[""], geolocation, inputs, redactions)
+
+  // Internal submissions and each platform get their own file too
+  if segment := Segment(platform, ip); segment != "" {
+    A.Daily[segment] = C.addToJsonObject(A.Daily[segment], geolocation, inputs, redactions)
+  } else {
+    C.logf("Invalid Platform ID: %s", platform)
+  }
+
+  // MONTHLY STATS OBJECT
+  if _, ok:= A.MonthIDs[id] ; !ok {
+    A.MonthIDs[id] = true
+    //increment the system count
+    A.Month.Syscount = A.Month.Syscount+1
+    if len(geolocation)>0 {
+      A.Month.Country[geolocation] += 1
+    }
+    A.Month = C.addInputsToStats(A.Month, inputs, redactions)
+    C.addCrosstabs(&A.Month, inputs, geolocation)
+  }
+  return nil
+}
+
+// Deep copy of the counters, safe to read or serialize while this
+// aggregator keeps counting
+func (A *Aggregator) Snapshot() (*Aggregator, error) {
+  data, err := json.Marshal(A)
+  if err != nil { return nil, err }
+  copy := &Aggregator{config: A.config}
+  if err := json.Unmarshal(data, copy); err != nil { return nil, err }
+  return copy, nil
+}
+
+// Add every counter and ID of other into this aggregator
+func (A *Aggregator) Merge(other *Aggregator) {
+  if A.Daily == nil { A.ResetDay() }
+  if A.MonthIDs == nil { A.ResetMonth() }
+  for segment, out := range(other.Daily) {
+    A.Daily[segment] = MergeOutput(A.Daily[segment], out)
+  }
+  for id := range(other.DailyIDs) { A.DailyIDs[id] = true }
+  A.Month = MergeOutput(A.Month, other.Month)
+  for id := range(other.MonthIDs) { A.MonthIDs[id] = true }
+}
@@ -0,0 +1,67 @@
+package aggregator
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "strings"
+  "testing"
+)
+
+func decode(t testing.TB, data string) map[string]interface{} {
+  var inputs map[string]interface{}
+  decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+  decoder.UseNumber()
+  if err := decoder.Decode(&inputs); err != nil { t.Fatal(err) }
+  return inputs
+}
+
+// Valid JSON the aggregator doesn't expect is counted as far as it can be
+// rather than panicking
+func TestAddMalformed(t *testing.T) {
+  payloads := []string{
+    `{"system_hash": "a", "platform": "FreeNAS", "pools": null}`,
+    `{"system_hash": "a", "platform": "FreeNAS", "pools": [1, "x", null]}`,
+    `{"system_hash": "a", "platform": "FreeNAS", "pools": {"type": "raidz2"}}`,
+    `{"system_hash": "a", "platform": "FreeNAS", "jails": [{"name": null}, {"name": {"x": 1}}, {"name": 5}]}`,
+    `{"system_hash": "a", "platform": "FreeNAS", "network": {"lags": [{"members": null}, {"members": [null, 1]}, {"members": "igb0"}]}}`,
+    `{"system_hash": "a", "platform": "FreeNAS", "plugins": [{"name": ["a", "b"]}]}`,
+  }
+  config := Config{ArrayKeys: []ArrayKeyRule{{Path: "plugins", Key: "name@version"}}}
+  for _, payload := range(payloads) {
+    A, err := New(config)
+    if err != nil { t.Fatal(err) }
+    func() {
+      defer func() {
+        if r := recover(); r != nil { t.Errorf("%s: panic: %v", payload, r) }
+      }()
+      if err := A.Add(decode(t, payload), Meta{Country: "US", IP: "1.2.3.4"}); err != nil {
+        t.Errorf("%s: %v", payload, err)
+      }
+    }()
+  }
+}
+
+func TestNumericKeys(t *testing.T) {
+  A, _ := New(Config{})
+  A.Add(decode(t, `{"system_hash": "a", "platform": "FreeNAS", "jails": [{"name": 5, "nat": true}]}`), Meta{IP: "1.2.3.4"})
+  if N := A.Daily[""].Stats.Lookup([]string{"jails", "5", "nat"}); N == nil || N.Buckets["true"] != 1 {
+    t.Errorf("jail keyed by a number not counted: %+v", N)
+  }
+}
+
+// Problems with a submission go to Config.Logf, not to stdout
+func TestAddLogf(t *testing.T) {
+  var logged []string
+  A, _ := New(Config{Logf: func(format string, v ...interface{}) {
+    logged = append(logged, fmt.Sprintf(format, v...))
+  }})
+  A.Add(decode(t, `{"system_hash": "a", "platform": "Bogus", "empty": {}}`), Meta{IP: "8.8.8.8"})
+  all := strings.Join(logged, "\n")
+  if !strings.Contains(all, "Invalid Platform ID: Bogus") || !strings.Contains(all, "Nothing counted for empty") {
+    t.Errorf("logged %q", logged)
+  }
+  // Without a hook nothing is reported
+  B, _ := New(Config{})
+  B.Add(decode(t, `{"system_hash": "a", "platform": "Bogus"}`), Meta{IP: "8.8.8.8"})
+}
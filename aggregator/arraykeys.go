@@ -0,0 +1,77 @@
+package aggregator
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// How elements of an array of objects are told apart in the stats
+type ArrayKeyRule struct{
+  // Schema path of the array, e.g. "plugins" or "network.lags"
+  Path string `json:"path"`
+  // Field(s) to key on. "name" keys on one field, "name@version" joins
+  // several into one key, and "" counts every element together with no key
+  Key string `json:"key"`
+}
+
+func (C *Config) find_array_key_rule(schema string) (ArrayKeyRule, bool) {
+  for _, rule := range(C.ArrayKeys) {
+    if MatchPath(rule.Path, schema) { return rule, true }
+  }
+  return ArrayKeyRule{}, false
+}
+
+// Build the key(s) for one array element. A single field holding a list
+// gives one key per entry; inside a composite key a list is joined with
+// "+", so a LAG keyed "type@members" is counted once as "LACP@igb1+igb2"
+func array_element_keys(rule ArrayKeyRule, M map[string]interface{}) []string {
+  if rule.Key == "" { return nil }
+  fields := strings.Split(rule.Key, "@")
+  if len(fields) == 1 {
+    val, ok := M[fields[0]]
+    if !ok || val == nil { return nil }
+    if list, islist := val.([]interface{}); islist {
+      var out []string
+      for _, item := range(list) {
+        if part, ok := key_part(item); ok { out = append(out, part) }
+      }
+      return out
+    }
+    if part, ok := key_part(val); ok { return []string{part} }
+    return nil
+  }
+  parts := make([]string, 0, len(fields))
+  found := false
+  for _, field := range(fields) {
+    val, ok := M[field]
+    if list, islist := val.([]interface{}); ok && islist {
+      items := make([]string, 0, len(list))
+      for _, item := range(list) {
+        if part, ok := key_part(item); ok { items = append(items, part) }
+      }
+      sort.Strings(items)
+      parts = append(parts, strings.Join(items, "+"))
+      found = true
+    } else if part, ok := key_part(val); ok {
+      parts = append(parts, part)
+      found = true
+    } else {
+      parts = append(parts, "unknown")
+    }
+  }
+  // None of the fields exist: count it with the un-keyed elements
+  if !found { return nil }
+  return []string{strings.Join(parts, "@")}
+}
+
+// A single value as a key, false for nulls, objects and arrays
+func key_part(val interface{}) (string, bool) {
+  switch v := val.(type) {
+    case string:
+      return v, true
+    case nil, map[string]interface{}, []interface{}:
+      return "", false
+  }
+  return fmt.Sprintf("%v", val), true
+}
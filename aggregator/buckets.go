@@ -0,0 +1,223 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "math"
+  "strconv"
+  "strings"
+)
+
+// How to turn a numeric stat into a bucket label
+type BucketRule struct{
+  // Stat path this rule applies to, "*" matches any run of characters.
+  // Array elements are written as "[]", e.g. "pools[].capacity"
+  Path string `json:"path"`
+  // Unit conversion before bucketing: "", "bytes_to_mb", "bytes_to_gb" or "bytes_to_tb"
+  Unit string `json:"unit"`
+  // Bucketing strategy: "exact", "rounded", "linear", "log2" or "edges"
+  Bucket string `json:"bucket"`
+  // Bucket width for "linear"
+  Width float64 `json:"width"`
+  // Ascending bucket edges for "edges"
+  Edges []float64 `json:"edges"`
+}
+
+// Used for any numeric field no rule matches
+var FALLBACK_RULE = BucketRule{Path: "*", Bucket: "exact"}
+
+// Divisor and label suffix for each unit conversion
+var bucket_units = map[string]struct{ div int64; suffix string }{
+  "": {1, ""},
+  "bytes_to_mb": {1024 * 1024, "MB"},
+  "bytes_to_gb": {1024 * 1024 * 1024, "GB"},
+  "bytes_to_tb": {1024 * 1024 * 1024 * 1024, "TB"},
+}
+
+// The historical behaviour: byte counts rounded to GB, and a few counts
+// rounded, matched on the field name wherever it appears
+func default_bucket_rules() []BucketRule {
+  var rules []BucketRule
+  gb := []string{"memory", "capacity", "total_size", "filesize", "data_without_backup_size",
+    "cloudsync", "rsync", "zfs_replication", "rsynctask", "usedby*"}
+  for _, key := range(gb) {
+    rules = append(rules, BucketRule{Path: key, Unit: "bytes_to_gb", Bucket: "rounded"})
+    rules = append(rules, BucketRule{Path: "*." + key, Unit: "bytes_to_gb", Bucket: "rounded"})
+  }
+  for _, key := range([]string{"snapshots", "datasets"}) {
+    rules = append(rules, BucketRule{Path: key, Bucket: "rounded"})
+    rules = append(rules, BucketRule{Path: "*." + key, Bucket: "rounded"})
+  }
+  return rules
+}
+var DEFAULT_BUCKET_RULES = default_bucket_rules()
+
+// Read a rules file (a JSON list of BucketRule)
+func LoadBucketRules(path string) ([]BucketRule, error) {
+  if path == "" { return nil, nil }
+  dat, err := ioutil.ReadFile(path)
+  if err != nil { return nil, err }
+  var rules []BucketRule
+  if err := json.Unmarshal(dat, &rules); err != nil {
+    return nil, err
+  }
+  for _, rule := range(rules) {
+    if err := check_bucket_rule(rule); err != nil {
+      return nil, fmt.Errorf("%s: %v", path, err)
+    }
+  }
+  return rules, nil
+}
+
+func check_bucket_rule(rule BucketRule) error {
+  if rule.Path == "" {
+    return fmt.Errorf("bucket rule without a path")
+  }
+  if _, ok := bucket_units[rule.Unit]; !ok {
+    return fmt.Errorf("%s: unknown unit %q", rule.Path, rule.Unit)
+  }
+  switch rule.Bucket {
+    case "", "exact", "rounded", "log2":
+    case "linear":
+      if rule.Width <= 0 {
+        return fmt.Errorf("%s: linear buckets need a positive width", rule.Path)
+      }
+    case "edges":
+      if len(rule.Edges) == 0 {
+        return fmt.Errorf("%s: edges buckets need at least one edge", rule.Path)
+      }
+      for i := 1; i < len(rule.Edges); i++ {
+        if rule.Edges[i] <= rule.Edges[i-1] {
+          return fmt.Errorf("%s: edges must be ascending", rule.Path)
+        }
+      }
+    default:
+      return fmt.Errorf("%s: unknown bucket strategy %q", rule.Path, rule.Bucket)
+  }
+  return nil
+}
+
+// Glob match where "*" matches any run of characters (dots included)
+func MatchPath(pattern string, statpath string) bool {
+  for len(pattern) > 0 {
+    if pattern[0] == '*' {
+      for len(pattern) > 0 && pattern[0] == '*' { pattern = pattern[1:] }
+      if pattern == "" { return true }
+      for i := 0; i <= len(statpath); i++ {
+        if MatchPath(pattern, statpath[i:]) { return true }
+      }
+      return false
+    }
+    if statpath == "" || pattern[0] != statpath[0] { return false }
+    pattern = pattern[1:]
+    statpath = statpath[1:]
+  }
+  return statpath == ""
+}
+
+// Drop the unique keys from a stat path: "jails[11.2-RELEASE].nat" is
+// counted under "jails[]" as far as the rules are concerned
+func SchemaPath(statpath string) string {
+  if !strings.Contains(statpath, "[") { return statpath }
+  var out strings.Builder
+  for i := 0; i < len(statpath); i++ {
+    out.WriteByte(statpath[i])
+    if statpath[i] == '[' {
+      end := strings.IndexByte(statpath[i:], ']')
+      if end < 0 { break }
+      i += end - 1
+    }
+  }
+  return out.String()
+}
+
+// The keys leading to a stat path's bucket map inside the nested Stats:
+// "jails[11.2-RELEASE].nat" is Stats["jails"]["11.2-RELEASE"]["nat"]
+// while "pools[].type" is Stats["pools"]["type"]
+func StatsKeys(statpath string) []string {
+  var keys []string
+  cur := ""
+  for i := 0; i < len(statpath); i++ {
+    switch statpath[i] {
+      case '.':
+        if cur != "" { keys = append(keys, cur) }
+        cur = ""
+      case '[':
+        if cur != "" { keys = append(keys, cur) }
+        cur = ""
+        end := strings.IndexByte(statpath[i:], ']')
+        if end < 0 { end = len(statpath) - i }
+        if end > 1 { keys = append(keys, statpath[i+1:i+end]) }
+        i += end
+      default:
+        cur += string(statpath[i])
+    }
+  }
+  if cur != "" { keys = append(keys, cur) }
+  return keys
+}
+
+// First configured rule matching the path, then the defaults, then exact
+func (C *Config) find_bucket_rule(statpath string) BucketRule {
+  for _, rule := range(C.BucketRules) {
+    if MatchPath(rule.Path, statpath) { return rule }
+  }
+  for _, rule := range(DEFAULT_BUCKET_RULES) {
+    if MatchPath(rule.Path, statpath) { return rule }
+  }
+  return FALLBACK_RULE
+}
+
+func format_number(val float64) string {
+  return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+// Bucket labels are a single value ("16GB") or a half open range "lo-hi"
+// with the unit on the end ("16-32GB"); open ended ranges are "<lo" / ">=hi"
+func bucket_label(rule BucketRule, num number_value) string {
+  unit := bucket_units[rule.Unit]
+  val := num.f / float64(unit.div)
+  switch rule.Bucket {
+    case "rounded":
+      // Whole units, then rounded to 10/100/1000 as they get bigger
+      n := int(math.Floor(val))
+      if num.isint {
+        // Integer division, so huge byte counts don't lose precision
+        n = int(num.i / unit.div)
+        if num.i < 0 && num.i % unit.div != 0 { n-- }
+      }
+      if ( n > 10000 ) {
+        n = round_to_thousand(n);
+      } else if ( n > 1000 ) {
+        n = round_to_hundred(n);
+      } else if ( n > 100 ) {
+        n = round_to_ten(n);
+      }
+      return strconv.Itoa(n) + unit.suffix
+    case "linear":
+      lo := math.Floor(val / rule.Width) * rule.Width
+      return format_number(lo) + "-" + format_number(lo + rule.Width) + unit.suffix
+    case "log2":
+      if val < 1 {
+        return "<1" + unit.suffix
+      }
+      lo := math.Pow(2, math.Floor(math.Log2(val)))
+      return format_number(lo) + "-" + format_number(lo*2) + unit.suffix
+    case "edges":
+      if val < rule.Edges[0] {
+        return "<" + format_number(rule.Edges[0]) + unit.suffix
+      }
+      for i := 1; i < len(rule.Edges); i++ {
+        if val < rule.Edges[i] {
+          return format_number(rule.Edges[i-1]) + "-" + format_number(rule.Edges[i]) + unit.suffix
+        }
+      }
+      return ">=" + format_number(rule.Edges[len(rule.Edges)-1]) + unit.suffix
+  }
+  // exact
+  if num.isint && num.i % unit.div == 0 {
+    return strconv.FormatInt(num.i / unit.div, 10) + unit.suffix
+  }
+  return format_number(val) + unit.suffix
+}
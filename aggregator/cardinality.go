@@ -0,0 +1,332 @@
+package aggregator
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "hash/fnv"
+  "math"
+  "math/bits"
+  "sort"
+  "strings"
+)
+
+// Bucket collecting everything that fell out of a capped top-K
+const OTHER_BUCKET = "__other__"
+
+// Per-path cap on the number of distinct string values kept
+type CardinalityRule struct{
+  Path string `json:"path"`
+  Limit int `json:"limit"`
+}
+
+// Space-Saving state for one capped bucket map. The map itself holds the
+// counts seen for each kept value since it was last let in, Errors holds
+// how many more it may have had before that (its Space-Saving estimate is
+// count + error), and __other__ holds the counts of evicted values, so the
+// map still adds up to the number of observations.
+type cardinality_info struct{
+  Limit int `json:"limit"`
+  Observations float64 `json:"observations"`
+  Errors map[string]float64 `json:"errors,omitempty"`
+  Distinct hyperloglog `json:"distinct"`
+  // For a capped keyed array ("plugins" keyed by name) the keys are child
+  // maps rather than bucket counts, so the number of elements counted
+  // under each kept key (and __other__) is kept here
+  Keys map[string]uint64 `json:"keys,omitempty"`
+}
+
+// Cap for a schema path, 0 when it isn't capped
+func (C *Config) cardinality_limit(schema string) int {
+  for _, rule := range(C.Cardinality) {
+    if MatchPath(rule.Path, schema) { return rule.Limit }
+  }
+  return 0
+}
+
+func addCappedStringToMap(OUTMAP *Output, M *StatsNode, name string, statpath string, limit int) {
+  if OUTMAP.Cardinality == nil {
+    OUTMAP.Cardinality = make(map[string]*cardinality_info)
+  }
+  info := OUTMAP.Cardinality[statpath]
+  if info == nil {
+    // Values counted before the cap existed are observations too
+    info = &cardinality_info{Errors: make(map[string]float64)}
+    for value, num := range(M.Buckets) {
+      if value != OTHER_BUCKET { info.Distinct.Add(value) }
+      info.Observations += float64(num)
+    }
+    OUTMAP.Cardinality[statpath] = info
+  }
+  info.Limit = limit
+  if info.Errors == nil { info.Errors = make(map[string]float64) }
+  info.Observations++
+  info.Distinct.Add(name)
+
+  if _, ok := M.Buckets[name]; ok && name != OTHER_BUCKET {
+    M.Buckets[name]++
+    return
+  }
+  trim_to_limit(OUTMAP.Stats, M.Buckets, info, limit)
+  if kept_values(M.Buckets) < limit {
+    OUTMAP.Stats.add(M, name, 1)
+    return
+  }
+  // Full: the new value replaces the one with the smallest estimate and
+  // inherits that estimate as its error, the old value's count moves
+  // to __other__
+  min_name, min_est := smallest_value(M.Buckets, info)
+  evict(OUTMAP.Stats, M.Buckets, info, min_name)
+  OUTMAP.Stats.add(M, name, 1)
+  info.Errors[name] = min_est
+}
+
+func kept_values(M map[string]uint64) int {
+  if _, ok := M[OTHER_BUCKET]; ok { return len(M) - 1 }
+  return len(M)
+}
+
+// Kept value with the smallest Space-Saving estimate
+func smallest_value(M map[string]uint64, info *cardinality_info) (string, float64) {
+  min_name, min_est := "", math.Inf(1)
+  for value, num := range(M) {
+    if value == OTHER_BUCKET { continue }
+    est := float64(num) + info.Errors[value]
+    if est < min_est || (est == min_est && value < min_name) {
+      min_name, min_est = value, est
+    }
+  }
+  return min_name, min_est
+}
+
+func evict(T *StatsTree, M map[string]uint64, info *cardinality_info, name string) {
+  M[OTHER_BUCKET] += M[name]
+  delete(M, name)
+  delete(info.Errors, name)
+  // Otherwise the intern table keeps every value the cap ever let in
+  T.unintern(name)
+}
+
+// Evict the smallest values into __other__ until at most limit are kept
+// (after the limit is lowered or two capped maps are merged)
+func trim_to_limit(T *StatsTree, M map[string]uint64, info *cardinality_info, limit int) {
+  for kept_values(M) > limit {
+    min_name, _ := smallest_value(M, info)
+    evict(T, M, info, min_name)
+  }
+}
+
+// Child key an element of a keyed array is counted under, with the keys
+// capped the same way as string values. The array's node M holds one
+// child per key: once limit keys are kept, a new key takes the place of
+// the one with the smallest estimate, and that key's whole sub-map moves
+// into the __other__ child.
+func capped_child_key(OUTMAP *Output, M *StatsNode, key string, statpath string, limit int) {
+  if OUTMAP.Cardinality == nil {
+    OUTMAP.Cardinality = make(map[string]*cardinality_info)
+  }
+  info := OUTMAP.Cardinality[statpath]
+  if info == nil {
+    info = &cardinality_info{Errors: make(map[string]float64)}
+    OUTMAP.Cardinality[statpath] = info
+  }
+  info.Limit = limit
+  if info.Errors == nil { info.Errors = make(map[string]float64) }
+  adopt_children(M, info)
+  info.Observations++
+  info.Distinct.Add(key)
+
+  if _, ok := info.Keys[key]; ok && key != OTHER_BUCKET {
+    info.Keys[key]++
+    return
+  }
+  trim_keys(OUTMAP, M, statpath, info, limit)
+  if kept_values(info.Keys) < limit {
+    info.Keys[key]++
+    return
+  }
+  min_name, min_est := smallest_value(info.Keys, info)
+  evict_key(OUTMAP, M, statpath, info, min_name)
+  info.Keys[key]++
+  info.Errors[key] = min_est
+}
+
+// Children counted before the cap existed (or merged in from an uncapped
+// file) are kept keys too, with one observation each
+func adopt_children(M *StatsNode, info *cardinality_info) {
+  if info.Keys == nil { info.Keys = make(map[string]uint64) }
+  for name := range(M.Children) {
+    if _, ok := info.Keys[name]; ok { continue }
+    info.Keys[name] = 1
+    info.Observations++
+    if name != OTHER_BUCKET { info.Distinct.Add(name) }
+  }
+}
+
+func evict_key(OUTMAP *Output, M *StatsNode, statpath string, info *cardinality_info, name string) {
+  T := OUTMAP.Stats
+  if C, ok := M.Children[name]; ok {
+    T.merge_node(T.child(M, OTHER_BUCKET), C)
+    delete(M.Children, name)
+  }
+  info.Keys[OTHER_BUCKET] += info.Keys[name]
+  delete(info.Keys, name)
+  delete(info.Errors, name)
+  T.unintern(name)
+  // Caps and type markers below the evicted key go with its counts
+  move_cardinality(OUTMAP, statpath+"["+name+"]", statpath+"["+OTHER_BUCKET+"]")
+  move_types(OUTMAP, statpath+"["+name+"]", statpath+"["+OTHER_BUCKET+"]")
+}
+
+func trim_keys(OUTMAP *Output, M *StatsNode, statpath string, info *cardinality_info, limit int) {
+  for kept_values(info.Keys) > limit {
+    min_name, _ := smallest_value(info.Keys, info)
+    evict_key(OUTMAP, M, statpath, info, min_name)
+  }
+}
+
+// Merge the cap state of every stat path under from into the same path
+// under to, then trim what it was merged into
+func move_cardinality(OUTMAP *Output, from string, to string) {
+  var moved []string
+  for statpath, info := range(OUTMAP.Cardinality) {
+    if !strings.HasPrefix(statpath, from) { continue }
+    rest := statpath[len(from):]
+    if rest != "" && rest[0] != '.' && rest[0] != '[' { continue }
+    delete(OUTMAP.Cardinality, statpath)
+    if dinfo := OUTMAP.Cardinality[to+rest]; dinfo != nil {
+      merge_info(dinfo, info)
+    } else {
+      OUTMAP.Cardinality[to+rest] = info
+    }
+    moved = append(moved, to+rest)
+  }
+  trim_cardinality(OUTMAP, moved)
+}
+
+// Bring each capped path back down to its limit, shortest paths first so
+// keys evicted from an array take the caps below them along before those
+// are trimmed
+func trim_cardinality(OUTMAP *Output, paths []string) {
+  sort.Slice(paths, func(i, j int) bool {
+    if len(paths[i]) != len(paths[j]) { return len(paths[i]) < len(paths[j]) }
+    return paths[i] < paths[j]
+  })
+  for _, statpath := range(paths) {
+    info := OUTMAP.Cardinality[statpath]
+    if info == nil { continue }
+    M := OUTMAP.Stats.Lookup(StatsKeys(statpath))
+    if M == nil { continue }
+    if info.Keys != nil {
+      adopt_children(M, info)
+      trim_keys(OUTMAP, M, statpath, info, info.Limit)
+    } else if M.Buckets != nil {
+      trim_to_limit(OUTMAP.Stats, M.Buckets, info, info.Limit)
+    }
+  }
+}
+
+// Add the Space-Saving state of src into dst. The lower limit wins.
+func merge_info(dinfo *cardinality_info, sinfo *cardinality_info) {
+  if dinfo.Errors == nil { dinfo.Errors = make(map[string]float64) }
+  dinfo.Observations += sinfo.Observations
+  for value, num := range(sinfo.Errors) { dinfo.Errors[value] += num }
+  dinfo.Distinct.Merge(sinfo.Distinct)
+  if sinfo.Limit > 0 && (dinfo.Limit == 0 || sinfo.Limit < dinfo.Limit) {
+    dinfo.Limit = sinfo.Limit
+  }
+  if sinfo.Keys != nil {
+    if dinfo.Keys == nil { dinfo.Keys = make(map[string]uint64) }
+    for key, num := range(sinfo.Keys) { dinfo.Keys[key] += num }
+  }
+}
+
+// Combine the Space-Saving state of two capped maps, the bucket counts
+// themselves have already been added together by merge_stats
+func merge_cardinality(dst Output, src Output) Output {
+  var paths []string
+  for statpath, sinfo := range(src.Cardinality) {
+    if dst.Cardinality == nil {
+      dst.Cardinality = make(map[string]*cardinality_info)
+    }
+    dinfo := dst.Cardinality[statpath]
+    if dinfo == nil {
+      dinfo = &cardinality_info{Limit: sinfo.Limit, Errors: make(map[string]float64)}
+      dst.Cardinality[statpath] = dinfo
+    }
+    merge_info(dinfo, sinfo)
+    paths = append(paths, statpath)
+  }
+  trim_cardinality(&dst, paths)
+  return dst
+}
+
+// HyperLogLog with 2^10 registers (~3% error) for the distinct count
+const HLL_BITS = 10
+
+type hyperloglog struct{
+  registers []byte
+}
+
+func hll_hash(value string) uint64 {
+  h := fnv.New64a()
+  h.Write([]byte(value))
+  // fnv alone doesn't spread short strings well, finish with splitmix64
+  x := h.Sum64()
+  x ^= x >> 30; x *= 0xbf58476d1ce4e5b9
+  x ^= x >> 27; x *= 0x94d049bb133111eb
+  x ^= x >> 31
+  return x
+}
+
+func (H *hyperloglog) Add(value string) {
+  if H.registers == nil { H.registers = make([]byte, 1<<HLL_BITS) }
+  x := hll_hash(value)
+  index := x >> (64 - HLL_BITS)
+  rank := byte(bits.LeadingZeros64(x<<HLL_BITS | 1<<(HLL_BITS-1)) + 1)
+  if rank > H.registers[index] { H.registers[index] = rank }
+}
+
+func (H *hyperloglog) Merge(other hyperloglog) {
+  if other.registers == nil { return }
+  if H.registers == nil { H.registers = make([]byte, 1<<HLL_BITS) }
+  for i, rank := range(other.registers) {
+    if rank > H.registers[i] { H.registers[i] = rank }
+  }
+}
+
+func (H *hyperloglog) Estimate() float64 {
+  if H.registers == nil { return 0 }
+  m := float64(len(H.registers))
+  sum := 0.0
+  zeros := 0.0
+  for _, rank := range(H.registers) {
+    sum += math.Pow(2, -float64(rank))
+    if rank == 0 { zeros++ }
+  }
+  est := 0.7213 / (1 + 1.079/m) * m * m / sum
+  if est <= 2.5*m && zeros > 0 {
+    // Small range correction
+    est = m * math.Log(m/zeros)
+  }
+  return math.Round(est)
+}
+
+func (H hyperloglog) MarshalJSON() ([]byte, error) {
+  return json.Marshal(struct{
+    Estimate float64 `json:"estimate"`
+    Registers string `json:"registers"`
+  }{H.Estimate(), base64.StdEncoding.EncodeToString(H.registers)})
+}
+
+func (H *hyperloglog) UnmarshalJSON(data []byte) error {
+  var in struct{
+    Registers string `json:"registers"`
+  }
+  if err := json.Unmarshal(data, &in); err != nil { return err }
+  regs, err := base64.StdEncoding.DecodeString(in.Registers)
+  if err != nil { return err }
+  if len(regs) == 1<<HLL_BITS {
+    H.registers = regs
+  }
+  return nil
+}
@@ -0,0 +1,162 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "fmt"
+  "math"
+  "testing"
+)
+
+// Sum of the bucket counts of one field over every child of a node
+func sum_field(M *StatsNode, field string) uint64 {
+  var total uint64
+  for _, C := range(M.Children) {
+    if F := C.Children[field]; F != nil {
+      for _, num := range(F.Buckets) { total += num }
+    }
+  }
+  return total
+}
+
+func TestCappedArrayKeys(t *testing.T) {
+  A, _ := New(Config{Cardinality: []CardinalityRule{
+    {Path: "plugins", Limit: 3},
+    {Path: "plugins[].version", Limit: 2},
+  }})
+  elements := 0
+  for i := 0; i < 200; i++ {
+    // plugin 0 in every submission, the rest spread thin
+    payload := fmt.Sprintf(`{"system_hash": "h%d", "platform": "FreeNAS", "plugins": [
+      {"name": "p0", "version": "v%d"}, {"name": "p%d", "version": "v%d"}]}`, i, i%5, 1+i%40, i%7)
+    if err := A.Add(decode(t, payload), Meta{IP: "1.2.3.4"}); err != nil { t.Fatal(err) }
+    elements += 2
+  }
+  out := A.Daily[""]
+  M := out.Stats.Lookup([]string{"plugins"})
+  if M == nil { t.Fatal("no plugins") }
+  if len(M.Children) > 4 {
+    t.Errorf("%d keys kept, want at most 3 and __other__", len(M.Children))
+  }
+  if M.Children["p0"] == nil || M.Children[OTHER_BUCKET] == nil {
+    t.Errorf("want p0 and __other__ kept, got %v", M.names())
+  }
+  if got := sum_field(M, "version"); got != uint64(elements) {
+    t.Errorf("version counts add up to %d, want %d", got, elements)
+  }
+  info := out.Cardinality["plugins"]
+  if info == nil || info.Observations != float64(elements) {
+    t.Fatalf("cap state for plugins: %+v", info)
+  }
+  var keys uint64
+  for _, num := range(info.Keys) { keys += num }
+  if keys != uint64(elements) { t.Errorf("key counts add up to %d, want %d", keys, elements) }
+  // Caps under evicted keys went with them into __other__
+  for statpath := range(out.Cardinality) {
+    if statpath == "plugins" { continue }
+    if N := out.Stats.Lookup(StatsKeys(statpath)); N == nil {
+      t.Errorf("cap state left for %s with no counts", statpath)
+    } else if kept_values(N.Buckets) > 2 {
+      t.Errorf("%s keeps %d values", statpath, kept_values(N.Buckets))
+    }
+  }
+
+  // Merging two capped outputs stays capped and keeps every count
+  merged := MergeOutput(MergeOutput(empty_output(), out), out)
+  M = merged.Stats.Lookup([]string{"plugins"})
+  if len(M.Children) > 4 || sum_field(M, "version") != uint64(2*elements) {
+    t.Errorf("merged: %d keys, %d versions", len(M.Children), sum_field(M, "version"))
+  }
+}
+
+// Space-Saving keeps the heavy hitters, and every kept value's estimate
+// is an upper bound on its true count with count as the lower bound
+func TestSpaceSaving(t *testing.T) {
+  A, _ := New(Config{Cardinality: []CardinalityRule{{Path: "model", Limit: 5}}})
+  truth := make(map[string]uint64)
+  for i := 0; i < 2000; i++ {
+    // m0-m2 take 3/4 of the stream, the rest is a long tail
+    model := fmt.Sprintf("m%d", i % 4)
+    if i % 4 == 3 { model = fmt.Sprintf("tail%d", i % 97) }
+    truth[model]++
+    payload := fmt.Sprintf(`{"system_hash": "h%d", "platform": "FreeNAS", "model": %q}`, i, model)
+    if err := A.Add(decode(t, payload), Meta{IP: "1.2.3.4"}); err != nil { t.Fatal(err) }
+  }
+  out := A.Daily[""]
+  M := out.Stats.Lookup([]string{"model"})
+  info := out.Cardinality["model"]
+  if M == nil || info == nil { t.Fatal("model not capped") }
+  if kept_values(M.Buckets) > 5 { t.Errorf("%d values kept", kept_values(M.Buckets)) }
+  var total uint64
+  for value, num := range(M.Buckets) {
+    total += num
+    if value == OTHER_BUCKET { continue }
+    if num > truth[value] || float64(num) + info.Errors[value] < float64(truth[value]) {
+      t.Errorf("%s: count %d error %v, true count %d", value, num, info.Errors[value], truth[value])
+    }
+  }
+  if total != 2000 || info.Observations != 2000 {
+    t.Errorf("counts add up to %d, %v observations", total, info.Observations)
+  }
+  for _, model := range([]string{"m0", "m1", "m2"}) {
+    if _, ok := M.Buckets[model]; !ok { t.Errorf("heavy hitter %s evicted", model) }
+  }
+  if est := info.Distinct.Estimate(); math.Abs(est - float64(len(truth))) > 0.1 * float64(len(truth)) {
+    t.Errorf("distinct estimate %v, really %d", est, len(truth))
+  }
+}
+
+// The distinct count is close, and merging two sketches counts the union
+func TestHyperLogLog(t *testing.T) {
+  var whole, a, b hyperloglog
+  for i := 0; i < 20000; i++ {
+    value := fmt.Sprintf("value-%d", i)
+    whole.Add(value)
+    // Overlapping halves
+    if i < 12000 { a.Add(value) }
+    if i >= 8000 { b.Add(value) }
+  }
+  if est := whole.Estimate(); math.Abs(est - 20000) > 0.05 * 20000 {
+    t.Errorf("estimate %v for 20000", est)
+  }
+  a.Merge(b)
+  if a.Estimate() != whole.Estimate() {
+    t.Errorf("merged estimate %v, whole %v", a.Estimate(), whole.Estimate())
+  }
+  var empty hyperloglog
+  if empty.Estimate() != 0 { t.Error("empty sketch counts something") }
+  data, _ := json.Marshal(whole)
+  var back hyperloglog
+  if err := json.Unmarshal(data, &back); err != nil || back.Estimate() != whole.Estimate() {
+    t.Errorf("round trip: %v %v", back.Estimate(), err)
+  }
+}
+
+// Type markers under evicted keys move into __other__ with the counts
+func TestCappedKeysTypesBounded(t *testing.T) {
+  A, _ := New(Config{
+    ArrayKeys: []ArrayKeyRule{{Path: "plugins", Key: "name"}},
+    Cardinality: []CardinalityRule{{Path: "plugins", Limit: 3}},
+  })
+  for i := 0; i < 1000; i++ {
+    payload := fmt.Sprintf(`{"system_hash": "h%d", "platform": "FreeNAS",
+      "plugins": [{"name": "p%d", "version": "1.%d", "enabled": true}]}`, i, i, i % 3)
+    if err := A.Add(decode(t, payload), Meta{IP: "1.2.3.4"}); err != nil { t.Fatal(err) }
+  }
+  out := A.Daily[""]
+  // name, version and enabled under 3 kept keys and __other__, plus platform
+  if len(out.Types) > 13 {
+    t.Errorf("%d type markers for 4 kept keys", len(out.Types))
+  }
+  if out.Types["plugins["+OTHER_BUCKET+"].enabled"] != "bool" {
+    t.Errorf("no type for __other__: %v", out.Types)
+  }
+  merged := MergeOutput(MergeOutput(empty_output(), out), A.Month)
+  if len(merged.Types) > 13 {
+    t.Errorf("%d type markers after a merge", len(merged.Types))
+  }
+  for statpath := range(merged.Types) {
+    if merged.Stats.Lookup(StatsKeys(statpath)) == nil {
+      t.Errorf("type marker left for %s with no counts", statpath)
+    }
+  }
+}
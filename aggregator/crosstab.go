@@ -0,0 +1,222 @@
+package aggregator
+
+import (
+  "fmt"
+  "strings"
+)
+
+// Dimension taken from the GeoIP lookup rather than the submission
+const COUNTRY_DIMENSION = "country"
+
+// A pair of dimensions counted against each other. Each is "country" or
+// the schema path of a submitted field, "[]" reaching into every element
+// of an array: "pools[].type" gives the types of all of a system's pools.
+type CrosstabRule struct{
+  Rows string `json:"rows"`
+  Columns string `json:"columns"`
+}
+
+// Key the rule's table is stored under, e.g. "country/platform"
+func (R CrosstabRule) Name() string {
+  return R.Rows + "/" + R.Columns
+}
+
+// Catch empty or repeated dimensions before the aggregator gets them
+func CheckCrosstabRules(rules []CrosstabRule) error {
+  seen := make(map[string]bool)
+  for _, rule := range(rules) {
+    if rule.Rows == "" || rule.Columns == "" {
+      return fmt.Errorf("crosstab %q: rows and columns are both needed", rule.Name())
+    }
+    if rule.Rows == rule.Columns {
+      return fmt.Errorf("crosstab %q: rows and columns are the same", rule.Name())
+    }
+    if seen[rule.Name()] {
+      return fmt.Errorf("crosstab %q: listed twice", rule.Name())
+    }
+    seen[rule.Name()] = true
+  }
+  return nil
+}
+
+// Count one submission in every configured table. A submission adds 1 to
+// each pair of its row and column values (a system with two raidz2 pools
+// counts once for raidz2), and nothing to a table where either dimension
+// is missing. A dimension with a cardinality rule keeps its top values
+// the same way a capped string field does, the rest are counted as
+// __other__.
+func (C *Config) addCrosstabs(OUTMAP *Output, inputs map[string]interface{}, geolocation string) {
+  for _, rule := range(C.Crosstabs) {
+    rows := C.dimension_values(inputs, rule.Rows, geolocation)
+    cols := C.dimension_values(inputs, rule.Columns, geolocation)
+    if len(rows) == 0 || len(cols) == 0 { continue }
+    if OUTMAP.Crosstab == nil {
+      OUTMAP.Crosstab = make(map[string]map[string]map[string]float64)
+    }
+    name := rule.Name()
+    table := OUTMAP.Crosstab[name]
+    if table == nil {
+      table = make(map[string]map[string]float64)
+      OUTMAP.Crosstab[name] = table
+    }
+    if limit := C.cardinality_limit(SchemaPath(rule.Rows)); limit > 0 {
+      for row := range(rows) { cap_crosstab_value(OUTMAP, table, name, "rows", row, limit) }
+    }
+    if limit := C.cardinality_limit(SchemaPath(rule.Columns)); limit > 0 {
+      for col := range(cols) { cap_crosstab_value(OUTMAP, table, name, "columns", col, limit) }
+    }
+    for row := range(rows) {
+      if table[row] == nil { table[row] = make(map[string]float64) }
+      for col := range(cols) {
+        table[row][col] += 1
+      }
+    }
+  }
+}
+
+// Where the cap state of one side of a table is kept in Output.Cardinality
+func crosstab_cap_key(name string, side string) string {
+  return "crosstab:" + name + ":" + side
+}
+
+// Total count of each row (or column) of a table
+func crosstab_totals(table map[string]map[string]float64, side string) map[string]uint64 {
+  totals := make(map[string]uint64)
+  for row, cols := range(table) {
+    for col, num := range(cols) {
+      if side == "rows" {
+        totals[row] += uint64(num)
+      } else {
+        totals[col] += uint64(num)
+      }
+    }
+  }
+  return totals
+}
+
+// Make room for value on one side of a capped table: once limit values
+// are kept, the one with the smallest Space-Saving estimate is folded
+// into __other__ and value inherits that estimate as its error
+func cap_crosstab_value(OUTMAP *Output, table map[string]map[string]float64, name string, side string, value string, limit int) {
+  if OUTMAP.Cardinality == nil {
+    OUTMAP.Cardinality = make(map[string]*cardinality_info)
+  }
+  key := crosstab_cap_key(name, side)
+  info := OUTMAP.Cardinality[key]
+  if info == nil {
+    info = &cardinality_info{}
+    OUTMAP.Cardinality[key] = info
+  }
+  info.Limit = limit
+  if info.Errors == nil { info.Errors = make(map[string]float64) }
+  info.Observations++
+  info.Distinct.Add(value)
+  totals := crosstab_totals(table, side)
+  if _, ok := totals[value]; ok && value != OTHER_BUCKET { return }
+  trim_crosstab(table, side, info, limit)
+  totals = crosstab_totals(table, side)
+  if kept_values(totals) < limit { return }
+  min_name, min_est := smallest_value(totals, info)
+  fold_crosstab(table, side, info, min_name)
+  info.Errors[value] = min_est
+}
+
+// Move a row (or column) of a table into __other__
+func fold_crosstab(table map[string]map[string]float64, side string, info *cardinality_info, value string) {
+  delete(info.Errors, value)
+  if side == "rows" {
+    if table[OTHER_BUCKET] == nil { table[OTHER_BUCKET] = make(map[string]float64) }
+    for col, num := range(table[value]) { table[OTHER_BUCKET][col] += num }
+    delete(table, value)
+    return
+  }
+  for _, cols := range(table) {
+    if num, ok := cols[value]; ok {
+      cols[OTHER_BUCKET] += num
+      delete(cols, value)
+    }
+  }
+}
+
+// Fold the smallest values into __other__ until at most limit are kept
+func trim_crosstab(table map[string]map[string]float64, side string, info *cardinality_info, limit int) {
+  for {
+    totals := crosstab_totals(table, side)
+    if kept_values(totals) <= limit { return }
+    min_name, _ := smallest_value(totals, info)
+    fold_crosstab(table, side, info, min_name)
+  }
+}
+
+// Distinct values of one dimension in a submission, labelled the way the
+// stats label them (numbers go through the bucket rules)
+func (C *Config) dimension_values(inputs map[string]interface{}, dim string, geolocation string) map[string]bool {
+  values := make(map[string]bool)
+  if dim == COUNTRY_DIMENSION {
+    if geolocation != "" { values[geolocation] = true }
+    return values
+  }
+  C.collect_dimension(inputs, dim, dim, values)
+  return values
+}
+
+func (C *Config) collect_dimension(Val interface{}, rest string, dim string, values map[string]bool) {
+  if rest == "" {
+    switch v := Val.(type) {
+      case nil:
+        values[NULL_BUCKET] = true
+      case bool:
+        values[fmt.Sprintf("%v", v)] = true
+      case string:
+        values[v] = true
+      case map[string]interface{}, []interface{}:
+        // Only single values make a row or column
+      default:
+        values[bucket_label(C.find_bucket_rule(dim), parse_number(v))] = true
+    }
+    return
+  }
+  if strings.HasPrefix(rest, "[]") {
+    list, ok := Val.([]interface{})
+    if !ok { return }
+    rest = strings.TrimPrefix(rest[2:], ".")
+    for _, elem := range(list) { C.collect_dimension(elem, rest, dim, values) }
+    return
+  }
+  M, ok := Val.(map[string]interface{})
+  if !ok { return }
+  end := strings.IndexAny(rest, ".[")
+  if end < 0 { end = len(rest) }
+  next, found := M[rest[:end]]
+  if !found { return }
+  rest = rest[end:]
+  if strings.HasPrefix(rest, ".") { rest = rest[1:] }
+  C.collect_dimension(next, rest, dim, values)
+}
+
+// Add src's tables into dst's, then bring capped sides back to their
+// limit (the cap state was merged by merge_cardinality)
+func merge_crosstabs(dst Output, src Output) Output {
+  for name, table := range(src.Crosstab) {
+    if dst.Crosstab == nil {
+      dst.Crosstab = make(map[string]map[string]map[string]float64)
+    }
+    if dst.Crosstab[name] == nil {
+      dst.Crosstab[name] = make(map[string]map[string]float64)
+    }
+    for row, cols := range(table) {
+      if dst.Crosstab[name][row] == nil {
+        dst.Crosstab[name][row] = make(map[string]float64)
+      }
+      for col, num := range(cols) {
+        dst.Crosstab[name][row][col] += num
+      }
+    }
+    for _, side := range([]string{"rows", "columns"}) {
+      if info := dst.Cardinality[crosstab_cap_key(name, side)]; info != nil && info.Limit > 0 {
+        trim_crosstab(dst.Crosstab[name], side, info, info.Limit)
+      }
+    }
+  }
+  return dst
+}
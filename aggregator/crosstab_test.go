@@ -0,0 +1,47 @@
+package aggregator
+
+import (
+  "fmt"
+  "testing"
+)
+
+// Sum of every cell of a table
+func table_total(table map[string]map[string]float64) float64 {
+  var total float64
+  for _, cols := range(table) {
+    for _, num := range(cols) { total += num }
+  }
+  return total
+}
+
+func TestCappedCrosstab(t *testing.T) {
+  A, _ := New(Config{
+    Crosstabs: []CrosstabRule{{Rows: "platform", Columns: "version"}},
+    Cardinality: []CardinalityRule{{Path: "version", Limit: 3}},
+  })
+  for i := 0; i < 300; i++ {
+    // v0 in every other submission, the rest spread thin
+    version := "v0"
+    if i % 2 == 1 { version = fmt.Sprintf("v%d", i) }
+    payload := fmt.Sprintf(`{"system_hash": "h%d", "platform": "FreeNAS", "version": %q}`, i, version)
+    if err := A.Add(decode(t, payload), Meta{IP: "1.2.3.4"}); err != nil { t.Fatal(err) }
+  }
+  out := A.Daily[""]
+  table := out.Crosstab["platform/version"]
+  if cols := table["FreeNAS"]; len(cols) > 4 || cols["v0"] != 150 || cols[OTHER_BUCKET] == 0 {
+    t.Errorf("want v0 with 150, at most 3 kept and __other__, got %v", cols)
+  }
+  if got := table_total(table); got != 300 {
+    t.Errorf("table counts add up to %v, want 300", got)
+  }
+  if info := out.Cardinality[crosstab_cap_key("platform/version", "columns")]; info == nil || info.Observations != 300 {
+    t.Errorf("cap state: %+v", info)
+  }
+
+  // Merging stays capped and keeps every count
+  merged := MergeOutput(MergeOutput(empty_output(), out), out)
+  table = merged.Crosstab["platform/version"]
+  if len(table["FreeNAS"]) > 4 || table_total(table) != 600 {
+    t.Errorf("merged: %v", table)
+  }
+}
@@ -0,0 +1,102 @@
+package aggregator
+
+import (
+  "strings"
+)
+
+// Add every counter in src into dst (days into a longer period, or the
+// output of several collectors into one)
+func MergeOutput(dst Output, src Output) Output {
+  dst.Syscount += src.Syscount
+  dst.Capacity += src.Capacity
+  dst.CapacityBytes += src.CapacityBytes
+  dst.Disks += src.Disks
+  dst.Submissions += src.Submissions
+  if dst.Country == nil {
+    dst.Country = make(map[string]float64)
+  }
+  for code, num := range(src.Country) {
+    dst.Country[code] += num
+  }
+  dst.Stats = merge_stats(dst.Stats, src.Stats)
+  // Before the caps are trimmed, so types under evicted keys move too
+  dst = merge_types(dst, src)
+  dst = merge_cardinality(dst, src)
+  for statpath, summary := range(src.Summary) {
+    if dst.Summary == nil {
+      dst.Summary = make(map[string]*numeric_summary)
+    }
+    if dst.Summary[statpath] == nil {
+      dst.Summary[statpath] = new_numeric_summary()
+    }
+    dst.Summary[statpath].Merge(summary)
+  }
+  for statpath, num := range(src.Present) {
+    if dst.Present == nil {
+      dst.Present = make(map[string]float64)
+    }
+    dst.Present[statpath] += num
+  }
+  dst = merge_crosstabs(dst, src)
+  for reason, num := range(src.Redactions) {
+    if dst.Redactions == nil {
+      dst.Redactions = make(map[string]float64)
+    }
+    dst.Redactions[reason] += num
+  }
+  return dst
+}
+
+// Add the bucket counts of one stats tree into another
+func merge_stats(dst *StatsTree, src *StatsTree) *StatsTree {
+  if src == nil {
+    return dst
+  }
+  if dst == nil {
+    dst = NewStatsTree()
+  }
+  dst.Merge(src)
+  return dst
+}
+
+// Remember what kind of value ("number", "string", "bool" or "null") was
+// counted at a stat path. A null next to real values keeps the real type,
+// two different real types make the path "mixed".
+func record_type(OUTMAP *Output, statpath string, kind string) {
+  if OUTMAP.Types == nil {
+    OUTMAP.Types = make(map[string]string)
+  }
+  OUTMAP.Types[statpath] = combine_types(OUTMAP.Types[statpath], kind)
+}
+
+func combine_types(old string, kind string) string {
+  switch {
+    case old == "" || old == kind || old == "null":
+      return kind
+    case kind == "null":
+      return old
+  }
+  return "mixed"
+}
+
+func merge_types(dst Output, src Output) Output {
+  for statpath, kind := range(src.Types) {
+    if dst.Types == nil {
+      dst.Types = make(map[string]string)
+    }
+    dst.Types[statpath] = combine_types(dst.Types[statpath], kind)
+  }
+  return dst
+}
+
+// Move the type markers of every stat path under from to the same path
+// under to, so keys evicted into __other__ don't leave one behind each
+func move_types(OUTMAP *Output, from string, to string) {
+  for statpath, kind := range(OUTMAP.Types) {
+    if !strings.HasPrefix(statpath, from) { continue }
+    rest := statpath[len(from):]
+    if rest != "" && rest[0] != '.' && rest[0] != '[' { continue }
+    delete(OUTMAP.Types, statpath)
+    OUTMAP.Types[to+rest] = combine_types(OUTMAP.Types[to+rest], kind)
+  }
+}
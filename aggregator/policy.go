@@ -0,0 +1,138 @@
+package aggregator
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+  "regexp"
+)
+
+// What is allowed into the stats, applied to every submission before
+// anything is counted
+type Policy struct{
+  // If set, only scalar fields matching one of these paths are kept
+  Allow []string `json:"allow"`
+  // Fields (and everything under them) that are always dropped
+  Deny []string `json:"deny"`
+  // Regex replacements applied to string values
+  Scrub []ScrubRule `json:"scrub"`
+  // String fields replaced by a salted hash of their value
+  Hash []string `json:"hash"`
+  HashSalt string `json:"hash_salt"`
+}
+
+type ScrubRule struct{
+  Name string `json:"name"`
+  Pattern string `json:"pattern"`
+  Replace string `json:"replace"`
+  // Only scrub values under these paths (default everywhere)
+  Paths []string `json:"paths"`
+  // Never scrub values under these paths
+  Except []string `json:"except"`
+  re *regexp.Regexp
+}
+
+// Paths the default address scrubbers leave alone, a bare "22.12.4.2" is
+// a version there
+var ADDRESS_EXCEPT = []string{"*version*", "*release*"}
+
+// Scrubbers used when the config doesn't list its own
+func default_scrub_rules() []ScrubRule {
+  return []ScrubRule{
+    {Name: "email", Pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`, Replace: "__email__"},
+    {Name: "uuid", Pattern: `\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`, Replace: "__uuid__"},
+    // Addresses only when they are the whole value: "TrueNAS-SCALE-22.12.4.2"
+    // has four dotted numbers in it, MAC addresses and times have colons
+    {Name: "ipv4", Pattern: `^(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)(?:/\d{1,2})?$`, Replace: "__ip__", Except: ADDRESS_EXCEPT},
+    {Name: "ipv6", Pattern: `^(?:(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:)*[0-9A-Fa-f]{0,4}::(?:[0-9A-Fa-f]{1,4}:)*[0-9A-Fa-f]{0,4})(?:%\w+)?(?:/\d{1,3})?$`, Replace: "__ip__", Except: ADDRESS_EXCEPT},
+    {Name: "serial", Pattern: `.+`, Replace: "__serial__", Paths: []string{"*serial*"}},
+    {Name: "hostname", Pattern: `.+`, Replace: "__hostname__", Paths: []string{"*hostname*"}},
+  }
+}
+
+// Fill in defaults and compile the scrub patterns
+func CompilePolicy(conf Policy) (Policy, error) {
+  if conf.Scrub == nil {
+    conf.Scrub = default_scrub_rules()
+  }
+  for i := range(conf.Scrub) {
+    re, err := regexp.Compile(conf.Scrub[i].Pattern)
+    if err != nil {
+      return conf, fmt.Errorf("scrub rule %s: %v", conf.Scrub[i].Name, err)
+    }
+    conf.Scrub[i].re = re
+  }
+  return conf, nil
+}
+
+func MatchAny(patterns []string, statpath string) bool {
+  for _, pattern := range(patterns) {
+    if MatchPath(pattern, statpath) { return true }
+  }
+  return false
+}
+
+// Return a cleaned copy of a submission, counting every redaction by
+// "<action>:<path or rule>" in redactions
+func (C *Config) apply_policy(inputs map[string]interface{}, redactions map[string]float64) map[string]interface{} {
+  out := make(map[string]interface{}, len(inputs))
+  for key, val := range(inputs) {
+    if key=="system_hash" || key=="usage_version" {
+      // Never counted, leave them for Add
+      out[key] = val
+      continue
+    }
+    if clean, keep := C.policy_value(val, key, redactions); keep {
+      out[key] = clean
+    }
+  }
+  return out
+}
+
+func (C *Config) policy_value(val interface{}, statpath string, redactions map[string]float64) (interface{}, bool) {
+  if MatchAny(C.Policy.Deny, statpath) {
+    redactions["deny:"+statpath]++
+    return nil, false
+  }
+  switch v := val.(type) {
+    case map[string]interface{}:
+      out := make(map[string]interface{}, len(v))
+      for field, sub := range(v) {
+        if clean, keep := C.policy_value(sub, statpath+"."+field, redactions); keep {
+          out[field] = clean
+        }
+      }
+      return out, true
+
+    case []interface{}:
+      out := make([]interface{}, 0, len(v))
+      for _, sub := range(v) {
+        if clean, keep := C.policy_value(sub, statpath+"[]", redactions); keep {
+          out = append(out, clean)
+        }
+      }
+      return out, true
+  }
+
+  // Scalars from here on
+  if len(C.Policy.Allow) > 0 && !MatchAny(C.Policy.Allow, statpath) {
+    redactions["allow:"+statpath]++
+    return nil, false
+  }
+  str, ok := val.(string)
+  if !ok { return val, true }
+  if MatchAny(C.Policy.Hash, statpath) {
+    redactions["hash:"+statpath]++
+    sum := sha256.Sum256([]byte(C.Policy.HashSalt + str))
+    return "h:" + hex.EncodeToString(sum[:8]), true
+  }
+  for _, rule := range(C.Policy.Scrub) {
+    if len(rule.Paths) > 0 && !MatchAny(rule.Paths, statpath) { continue }
+    if MatchAny(rule.Except, statpath) { continue }
+    if rule.re.MatchString(str) {
+      redactions["scrub:"+rule.Name]++
+      str = rule.re.ReplaceAllString(str, rule.Replace)
+    }
+  }
+  return str, true
+}
@@ -0,0 +1,36 @@
+package aggregator
+
+import (
+  "testing"
+)
+
+func TestDefaultScrub(t *testing.T) {
+  policy, err := CompilePolicy(Policy{})
+  if err != nil { t.Fatal(err) }
+  C := &Config{Policy: policy}
+  cases := []struct{
+    path string
+    value string
+    want string
+  }{
+    {"network.address", "192.168.1.10", "__ip__"},
+    {"network.address", "10.0.0.0/8", "__ip__"},
+    {"network.address", "fe80::1%em0", "__ip__"},
+    {"network.address", "2001:db8:0:0:0:0:0:1", "__ip__"},
+    {"network.address", "::1", "__ip__"},
+    {"version", "TrueNAS-SCALE-22.12.4.2", "TrueNAS-SCALE-22.12.4.2"},
+    {"version", "22.12.4.2", "22.12.4.2"},
+    {"plugins[].version", "1.2.3.4", "1.2.3.4"},
+    {"network.mac", "00:1b:21:3a:4f:5e", "00:1b:21:3a:4f:5e"},
+    {"uptime", "12:34:56", "12:34:56"},
+    {"note", "host at 10.0.0.1", "host at 10.0.0.1"},
+    {"note", "mail admin@example.com", "mail __email__"},
+    {"system.hostname", "nas01", "__hostname__"},
+  }
+  for _, c := range(cases) {
+    got, _ := C.policy_value(c.value, c.path, make(map[string]float64))
+    if got != c.want {
+      t.Errorf("%s %q: got %q, want %q", c.path, c.value, got, c.want)
+    }
+  }
+}
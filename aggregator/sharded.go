@@ -0,0 +1,128 @@
+package aggregator
+
+import (
+  "hash/fnv"
+  "sync"
+)
+
+// One aggregator and the lock guarding it
+type shard struct{
+  lock sync.Mutex
+  agg *Aggregator
+}
+
+// Aggregator split into shards so submissions can be counted on every core
+// at once. Each submission is counted by one shard (picked by its
+// system_hash, so a system always lands in the same one) and the shards are
+// merged into a single Aggregator whenever a snapshot is taken. Unlike
+// Aggregator, it is safe for concurrent use.
+//
+// Merged results are the same as counting everything in one Aggregator,
+// except for capped (top-K) maps: each shard keeps its own top-K and the
+// merge combines them, which stays within the Space-Saving error bounds.
+type Sharded struct{
+  shards []*shard
+}
+
+// New sharded aggregator with n shards (at least 1)
+func NewSharded(config Config, n int) (*Sharded, error) {
+  if n < 1 { n = 1 }
+  S := &Sharded{}
+  for i := 0; i < n; i++ {
+    agg, err := New(config)
+    if err != nil { return nil, err }
+    S.shards = append(S.shards, &shard{agg: agg})
+  }
+  return S, nil
+}
+
+func (S *Sharded) Shards() int {
+  return len(S.shards)
+}
+
+func (S *Sharded) SetConfig(config Config) error {
+  // Compile once up front so either every shard gets it or none do
+  if _, err := CompilePolicy(config.Policy); err != nil { return err }
+  for _, sh := range(S.shards) {
+    sh.lock.Lock()
+    sh.agg.SetConfig(config)
+    sh.lock.Unlock()
+  }
+  return nil
+}
+
+func (S *Sharded) pick(inputs map[string]interface{}) *shard {
+  if len(S.shards) == 1 { return S.shards[0] }
+  id, _ := inputs["system_hash"].(string)
+  h := fnv.New32a()
+  h.Write([]byte(id))
+  return S.shards[h.Sum32() % uint32(len(S.shards))]
+}
+
+// Count one submission, see Aggregator.Add
+func (S *Sharded) Add(inputs map[string]interface{}, meta Meta) error {
+  sh := S.pick(inputs)
+  sh.lock.Lock()
+  defer sh.lock.Unlock()
+  return sh.agg.Add(inputs, meta)
+}
+
+// Merge every shard into a new Aggregator. Merging copies everything, so
+// the result doesn't share any maps with the shards.
+func (S *Sharded) Snapshot() *Aggregator {
+  out := &Aggregator{}
+  out.Reset()
+  for _, sh := range(S.shards) {
+    sh.lock.Lock()
+    out.config = sh.agg.config
+    out.Merge(sh.agg)
+    sh.lock.Unlock()
+  }
+  return out
+}
+
+func (S *Sharded) Reset() {
+  S.ResetDay()
+  S.ResetMonth()
+}
+
+func (S *Sharded) ResetDay() {
+  for _, sh := range(S.shards) {
+    sh.lock.Lock()
+    sh.agg.ResetDay()
+    sh.lock.Unlock()
+  }
+}
+
+func (S *Sharded) ResetMonth() {
+  for _, sh := range(S.shards) {
+    sh.lock.Lock()
+    sh.agg.ResetMonth()
+    sh.lock.Unlock()
+  }
+}
+
+// Replace the daily counters with stored ones, which go into the first
+// shard. Segments missing from daily start empty.
+func (S *Sharded) LoadDay(daily map[string]Output, ids map[string]bool) {
+  S.ResetDay()
+  sh := S.shards[0]
+  sh.lock.Lock()
+  defer sh.lock.Unlock()
+  for segment, out := range(daily) {
+    if out.Country == nil { out.Country = make(map[string]float64) }
+    sh.agg.Daily[segment] = out
+  }
+  if ids != nil { sh.agg.DailyIDs = ids }
+}
+
+// Replace the monthly counters with stored ones
+func (S *Sharded) LoadMonth(month Output, ids map[string]bool) {
+  S.ResetMonth()
+  sh := S.shards[0]
+  sh.lock.Lock()
+  defer sh.lock.Unlock()
+  if month.Country == nil { month.Country = make(map[string]float64) }
+  sh.agg.Month = month
+  if ids != nil { sh.agg.MonthIDs = ids }
+}
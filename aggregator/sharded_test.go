@@ -0,0 +1,45 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "fmt"
+  "testing"
+)
+
+// Without caps, the merged shards count exactly what a single aggregator
+// does
+func TestShardedMatchesSingle(t *testing.T) {
+  config := Config{
+    ArrayKeys: []ArrayKeyRule{{Path: "plugins", Key: "name"}},
+    Crosstabs: []CrosstabRule{{Rows: "country", Columns: "platform"}},
+  }
+  single, _ := New(config)
+  sharded, err := NewSharded(config, 4)
+  if err != nil { t.Fatal(err) }
+  platforms := []string{"FreeNAS", "TrueNAS", "TrueNAS-SCALE"}
+  countries := []string{"US", "DE", "", "BR"}
+  for i := 0; i < 400; i++ {
+    // Systems send more than once, some from the same address
+    payload := fmt.Sprintf(`{"system_hash": "h%d", "platform": %q, "version": "v%d",
+      "pools": [{"type": "raidz%d", "capacity": %d}], "plugins": [{"name": "p%d", "version": "%d"}]}`,
+      i % 150, platforms[i % 3], i % 5, 1 + i % 3, 1000 * (i % 13), i % 6, i % 4)
+    meta := Meta{Country: countries[i % 4], IP: fmt.Sprintf("8.8.%d.%d", i % 3, i % 7)}
+    if err := single.Add(decode(t, payload), meta); err != nil { t.Fatal(err) }
+    if err := sharded.Add(decode(t, payload), meta); err != nil { t.Fatal(err) }
+  }
+  merged := sharded.Snapshot()
+  for _, part := range([]struct{
+    name string
+    a, b interface{}
+  }{{"daily", single.Daily, merged.Daily}, {"month", single.Month, merged.Month}}) {
+    want, _ := json.Marshal(part.a)
+    got, _ := json.Marshal(part.b)
+    if string(got) != string(want) {
+      t.Errorf("%s differs:\nsharded %s\nsingle  %s", part.name, got, want)
+    }
+  }
+  if len(merged.DailyIDs) != len(single.DailyIDs) || len(merged.MonthIDs) != len(single.MonthIDs) {
+    t.Errorf("IDs: %d/%d daily, %d/%d month", len(merged.DailyIDs), len(single.DailyIDs),
+      len(merged.MonthIDs), len(single.MonthIDs))
+  }
+}
@@ -0,0 +1,304 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "math"
+)
+
+// Counters for one period / segment, stored as a stats file
+type Output struct{
+	Syscount uint  `json:"systems"`
+	Country map[string]float64 `json:"country"`
+	Capacity float64 `json:"total_capacity_gb"`
+	CapacityBytes uint64 `json:"total_capacity_bytes"`
+	Disks uint64 `json:"total_disks"`
+	Stats *StatsTree `json:"stats"`
+	Summary map[string]*numeric_summary `json:"summary,omitempty"`
+	Redactions map[string]float64 `json:"redactions,omitempty"`
+	Cardinality map[string]*cardinality_info `json:"cardinality,omitempty"`
+	Submissions uint `json:"submissions"`
+	Present map[string]float64 `json:"present,omitempty"`
+	Types map[string]string `json:"types,omitempty"`
+	// Cross-tabulated counts: table name, row value, column value
+	Crosstab map[string]map[string]map[string]float64 `json:"crosstab,omitempty"`
+
+}
+// Bucket counting fields sent as JSON null
+const NULL_BUCKET = "__null__"
+
+// A submitted number, kept as a 64-bit integer whenever it is one
+type number_value struct{
+	i int64
+	f float64
+	isint bool
+}
+
+// Convert any number the decoder can hand us (json.Number, float64 or
+// the Go integer types) into a number_value
+func parse_number(Val interface{}) number_value {
+	switch n := Val.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return number_value{i: i, f: float64(i), isint: true}
+		}
+		f, _ := n.Float64()
+		return parse_number(f)
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < (1 << 63) {
+			return number_value{i: int64(n), f: n, isint: true}
+		}
+		return number_value{f: n}
+	case float32:
+		return parse_number(float64(n))
+	case int:
+		return parse_number(int64(n))
+	case int8:
+		return parse_number(int64(n))
+	case int16:
+		return parse_number(int64(n))
+	case int32:
+		return parse_number(int64(n))
+	case int64:
+		return number_value{i: n, f: float64(n), isint: true}
+	case uint:
+		return parse_number(uint64(n))
+	case uint8:
+		return parse_number(uint64(n))
+	case uint16:
+		return parse_number(uint64(n))
+	case uint32:
+		return parse_number(uint64(n))
+	case uint64:
+		if n < (1 << 63) {
+			return number_value{i: int64(n), f: float64(n), isint: true}
+		}
+		return number_value{f: float64(n)}
+	}
+	return number_value{}
+}
+
+func (C *Config) addToJsonObject(OUTMAP Output, geolocation string, inputs map[string]interface{}, redactions map[string]float64 ) Output {
+
+    _, install := inputs["install"]
+    _, firstboot := inputs["firstboot"]
+
+    if ( ! install && ! firstboot ) {
+      // increment the system count - Only if not a first-boot / installer scenario
+      OUTMAP.Syscount = OUTMAP.Syscount+1
+      if len(geolocation)>0 {
+        cnum := OUTMAP.Country[geolocation]
+        OUTMAP.Country[geolocation] = cnum+1
+      }
+    }
+
+    OUTMAP = C.addInputsToStats(OUTMAP, inputs, redactions)
+    C.addCrosstabs(&OUTMAP, inputs, geolocation)
+    return OUTMAP
+}
+
+// Load all the input fields into the counters of one output object
+func (C *Config) addInputsToStats(OUTMAP Output, inputs map[string]interface{}, redactions map[string]float64) Output {
+    // Keep count of what the policy removed from this submission
+    for reason, num := range(redactions) {
+      if OUTMAP.Redactions == nil {
+        OUTMAP.Redactions = make(map[string]float64)
+      }
+      OUTMAP.Redactions[reason] += num
+    }
+    // Count which fields this submission sent at all, so a field's counts
+    // can be compared against the submissions that knew about it
+    OUTMAP.Submissions = OUTMAP.Submissions+1
+    if OUTMAP.Present == nil {
+      OUTMAP.Present = make(map[string]float64)
+    }
+    if OUTMAP.Stats == nil {
+      OUTMAP.Stats = NewStatsTree()
+    }
+    present := make(map[string]bool)
+    //Now start loading all the input fields and incrementing the counters in the map
+    for key := range(inputs) {
+      if key=="system_hash" || key=="usage_version" { continue }
+      findPresentPaths(present, inputs[key], key)
+      C.addToMap( &OUTMAP, &OUTMAP.Stats.StatsNode, key, inputs[key], key )
+    }
+    for statpath := range(present) {
+      OUTMAP.Present[statpath] += 1
+    }
+    OUTMAP = get_storage_totals(OUTMAP, inputs);
+    return OUTMAP
+}
+
+// Collect the schema path of every field in a submission (nulls included)
+func findPresentPaths(present map[string]bool, Val interface{}, statpath string) {
+  present[statpath] = true
+  switch v := Val.(type) {
+  case map[string]interface{}:
+    for field, sub := range(v) {
+      findPresentPaths(present, sub, statpath+"."+field)
+    }
+  case []interface{}:
+    for _, sub := range(v) {
+      findPresentPaths(present, sub, statpath+"[]")
+    }
+  }
+}
+
+func get_storage_totals( OutS Output, IN map[string]interface{}) Output {
+  // pools -> [] -> (capacity/disks), anything else sent as pools is skipped
+  list, _ := IN["pools"].([]interface{})
+  for _, obj := range(list) {
+    pool, ok := obj.(map[string]interface{})
+    if !ok { continue }
+    if val, ok2 := pool["capacity"] ; ok2 {
+      // Sum the exact bytes, and GB without rounding each pool down first
+      if n := parse_number(val); n.isint && n.i > 0 {
+        OutS.CapacityBytes += uint64(n.i)
+        OutS.Capacity += float64(n.i) / (1024 * 1024 * 1024)
+      } else if n.f > 0 {
+        OutS.CapacityBytes += uint64(n.f)
+        OutS.Capacity += n.f / (1024 * 1024 * 1024)
+      }
+    }
+    if val, ok2 := pool["disks"] ; ok2 {
+      if n := parse_number(val); n.isint && n.i > 0 {
+        OutS.Disks += uint64(n.i);
+      }
+    }
+  }
+  return OutS
+}
+
+// statpath is where Val sits in the submission, e.g. "hardware.memory",
+// "pools[].capacity" for a field of every element of the pools array, or
+// "jails[11.2-RELEASE].nat" for array elements counted under a unique key
+func (C *Config) addToMap( OUTMAP *Output, M *StatsNode, key string, Val interface{}, statpath string) {
+  if list, ok := Val.([]interface{}); ok {
+    C.addSliceToMap(OUTMAP, M, key, list, statpath)
+    return
+  }
+  T := OUTMAP.Stats
+  MF := T.child(M, key)
+
+  // Type marker for leaf values, used by the flat output
+  kind := ""
+  switch v := Val.(type) {
+  case nil:
+	// JSON null
+	T.add(MF, NULL_BUCKET, 1)
+	kind = "null"
+
+  case map[string]interface{}:
+	for field, sub := range(v) {
+	  C.addToMap(OUTMAP, MF, field, sub, statpath+"."+field)
+	}
+
+  case bool:
+	addBoolToMap(T, MF, v)
+	kind = "bool"
+
+  case json.Number, float64, float32, int, int8, int16, int32, int64,
+       uint, uint8, uint16, uint32, uint64:
+	C.addNumberToMap(OUTMAP, MF, parse_number(Val), statpath)
+	kind = "number"
+
+  case string:
+	C.addStringToMap(OUTMAP, MF, v, statpath)
+	kind = "string"
+
+  default:
+	C.logf("Unexpected value %v (%T) at %s", Val, Val, statpath)
+  }
+  if kind != "" { record_type(OUTMAP, statpath, kind) }
+  if MF.empty() { C.logf("Nothing counted for %s: %v", statpath, Val) }
+}
+
+// Keys to count an array element under, from the array_keys rule for the
+// array's path or else the first of name / release / members / type
+func (C *Config) findUniqueKey( M map[string]interface{}, statpath string) []string {
+  if rule, ok := C.find_array_key_rule(SchemaPath(statpath)); ok {
+    return array_element_keys(rule, M)
+  }
+  priority := []string{"name","release", "members", "type"}
+  val, ok := M[priority[0]]
+  num := 0
+  for !ok && (num < 3) {
+	num = num+1
+	val, ok = M[priority[num]]
+  }
+  var out []string
+  if !ok {
+    return out
+  } else if list, islist := val.([]interface{}); islist && num == 2 {
+    //This is a slice of keys, values that can't be a key are skipped
+    for _, i := range(list) {
+      if part, ok := key_part(i); ok { out = append(out, part) }
+    }
+  } else if part, ok := key_part(val); ok {
+    out = append(out, part)
+  }
+  return out
+}
+
+func (C *Config) addSliceToMap(OUTMAP *Output, M *StatsNode, key string, Val []interface{}, statpath string) {
+  for _, subval := range( Val ) {
+    if submap, ok := subval.(map[string]interface{}); ok {
+      //List of maps - Need to create a sub-map and add them in there
+
+      keys := C.findUniqueKey(submap, statpath)
+      if len(keys) == 0 {
+        C.addToMap(OUTMAP, M, key, submap, statpath+"[]")
+      } else {
+        MF := OUTMAP.Stats.child(M, key)
+        limit := C.cardinality_limit(SchemaPath(statpath))
+        for _, subKey := range(keys) {
+          if limit > 0 { capped_child_key(OUTMAP, MF, subKey, statpath, limit) }
+          C.addToMap(OUTMAP, MF, subKey, submap, statpath+"["+subKey+"]")
+        }
+      }
+    } else {
+      //Just a list of strings/numbers/etc - add them directly to the output map
+      C.addToMap(OUTMAP, M, key, subval, statpath+"[]")
+    }
+  } //end loop over elements
+}
+
+func (C *Config) addNumberToMap(OUTMAP *Output, M *StatsNode, val number_value, statpath string) {
+  //Convert / bucket the number according to the rule for this stat path
+  schema := SchemaPath(statpath)
+  name := bucket_label(C.find_bucket_rule(schema), val)
+  // Keep the raw value in the mergeable summary for this path too
+  if OUTMAP.Summary == nil {
+    OUTMAP.Summary = make(map[string]*numeric_summary)
+  }
+  if OUTMAP.Summary[schema] == nil {
+    OUTMAP.Summary[schema] = new_numeric_summary()
+  }
+  OUTMAP.Summary[schema].Add(val.f)
+  OUTMAP.Stats.add(M, name, 1)
+}
+
+func round_to_thousand(val int) int {
+  return int(math.Round( float64(val)/1000) * 1000)
+}
+
+func round_to_hundred(val int) int {
+  return int(math.Round( float64(val)/100 ) * 100)
+}
+
+func round_to_ten(val int) int {
+  return int(math.Round( float64(val)/10 ) * 10)
+}
+
+func (C *Config) addStringToMap(OUTMAP *Output, M *StatsNode, name string, statpath string) {
+  if limit := C.cardinality_limit(SchemaPath(statpath)); limit > 0 {
+    addCappedStringToMap(OUTMAP, M, name, statpath, limit)
+    return
+  }
+  OUTMAP.Stats.add(M, name, 1)
+}
+
+func addBoolToMap(T *StatsTree, M *StatsNode, val bool) {
+  name := "true"
+  if !val { name = "false" }
+  T.add(M, name, 1)
+}
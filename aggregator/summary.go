@@ -0,0 +1,159 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "math"
+  "sort"
+)
+
+// Relative accuracy of the percentile sketch (1%)
+const SKETCH_ACCURACY = 0.01
+
+// Mergeable summary of every raw value seen for one numeric stat path
+type numeric_summary struct{
+  Count uint64 `json:"count"`
+  Sum float64 `json:"sum"`
+  Min float64 `json:"min"`
+  Max float64 `json:"max"`
+  Sketch ddsketch `json:"sketch"`
+}
+
+// DDSketch: values are counted in logarithmic bins so any quantile is
+// within SKETCH_ACCURACY of the real value, and two sketches merge by
+// adding their bins together
+type ddsketch struct{
+  Positive map[int]uint64 `json:"positive,omitempty"`
+  Negative map[int]uint64 `json:"negative,omitempty"`
+  Zero uint64 `json:"zero,omitempty"`
+}
+
+var sketch_gamma = (1 + SKETCH_ACCURACY) / (1 - SKETCH_ACCURACY)
+var sketch_log_gamma = math.Log(sketch_gamma)
+
+func new_numeric_summary() *numeric_summary {
+  return &numeric_summary{Min: math.Inf(1), Max: math.Inf(-1)}
+}
+
+func (S *numeric_summary) Add(val float64) {
+  if math.IsNaN(val) || math.IsInf(val, 0) { return }
+  S.Count++
+  S.Sum += val
+  S.Min = math.Min(S.Min, val)
+  S.Max = math.Max(S.Max, val)
+  S.Sketch.Add(val)
+}
+
+// Fold another summary (another day or another collector) into this one
+func (S *numeric_summary) Merge(other *numeric_summary) {
+  if other == nil || other.Count == 0 { return }
+  if S.Count == 0 {
+    S.Min, S.Max = other.Min, other.Max
+  } else {
+    S.Min = math.Min(S.Min, other.Min)
+    S.Max = math.Max(S.Max, other.Max)
+  }
+  S.Count += other.Count
+  S.Sum += other.Sum
+  S.Sketch.Merge(other.Sketch)
+}
+
+func (S *numeric_summary) Mean() float64 {
+  if S.Count == 0 { return 0 }
+  return S.Sum / float64(S.Count)
+}
+
+// Estimated value at quantile q (0-1), clamped to the real min / max
+func (S *numeric_summary) Quantile(q float64) float64 {
+  if S.Count == 0 { return 0 }
+  val := S.Sketch.Quantile(q, S.Count)
+  return math.Max(S.Min, math.Min(S.Max, val))
+}
+
+// The percentiles are written out for readers but never read back,
+// they are always recalculated from the sketch
+func (S *numeric_summary) MarshalJSON() ([]byte, error) {
+  type plain numeric_summary
+  out := struct{
+    *plain
+    Mean float64 `json:"mean"`
+    P50 float64 `json:"p50"`
+    P90 float64 `json:"p90"`
+    P99 float64 `json:"p99"`
+  }{(*plain)(S), S.Mean(), S.Quantile(0.5), S.Quantile(0.9), S.Quantile(0.99)}
+  if S.Count == 0 {
+    // Min / Max are still +/-Inf, which JSON can't hold
+    empty := *S
+    empty.Min, empty.Max = 0, 0
+    out.plain = (*plain)(&empty)
+  }
+  return json.Marshal(out)
+}
+
+func (S *numeric_summary) UnmarshalJSON(data []byte) error {
+  type plain numeric_summary
+  var in plain
+  if err := json.Unmarshal(data, &in); err != nil { return err }
+  *S = numeric_summary(in)
+  if S.Count == 0 {
+    S.Min, S.Max = math.Inf(1), math.Inf(-1)
+  }
+  return nil
+}
+
+func sketch_index(val float64) int {
+  return int(math.Ceil(math.Log(val) / sketch_log_gamma))
+}
+
+// Representative value of a bin, within SKETCH_ACCURACY of anything in it
+func sketch_value(index int) float64 {
+  return 2 * math.Pow(sketch_gamma, float64(index)) / (sketch_gamma + 1)
+}
+
+func (D *ddsketch) Add(val float64) {
+  switch {
+    case val > 0:
+      if D.Positive == nil { D.Positive = make(map[int]uint64) }
+      D.Positive[sketch_index(val)]++
+    case val < 0:
+      if D.Negative == nil { D.Negative = make(map[int]uint64) }
+      D.Negative[sketch_index(-val)]++
+    default:
+      D.Zero++
+  }
+}
+
+func (D *ddsketch) Merge(other ddsketch) {
+  for index, num := range(other.Positive) {
+    if D.Positive == nil { D.Positive = make(map[int]uint64) }
+    D.Positive[index] += num
+  }
+  for index, num := range(other.Negative) {
+    if D.Negative == nil { D.Negative = make(map[int]uint64) }
+    D.Negative[index] += num
+  }
+  D.Zero += other.Zero
+}
+
+func (D *ddsketch) Quantile(q float64, count uint64) float64 {
+  rank := uint64(q * float64(count-1))
+  seen := uint64(0)
+  // Most negative first: the largest negative bin index
+  neg := make([]int, 0, len(D.Negative))
+  for index := range(D.Negative) { neg = append(neg, index) }
+  sort.Sort(sort.Reverse(sort.IntSlice(neg)))
+  for _, index := range(neg) {
+    seen += D.Negative[index]
+    if seen > rank { return -sketch_value(index) }
+  }
+  seen += D.Zero
+  if seen > rank { return 0 }
+  pos := make([]int, 0, len(D.Positive))
+  for index := range(D.Positive) { pos = append(pos, index) }
+  sort.Ints(pos)
+  for _, index := range(pos) {
+    seen += D.Positive[index]
+    if seen > rank { return sketch_value(index) }
+  }
+  if len(pos) > 0 { return sketch_value(pos[len(pos)-1]) }
+  return 0
+}
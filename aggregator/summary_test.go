@@ -0,0 +1,73 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "math"
+  "reflect"
+  "testing"
+)
+
+// Quantiles are within SKETCH_ACCURACY of the exact ones, negative and
+// zero values included
+func TestSketchQuantiles(t *testing.T) {
+  S := new_numeric_summary()
+  var values []float64
+  for i := -1000; i <= 9000; i++ {
+    values = append(values, float64(i))
+    S.Add(float64(i))
+  }
+  S.Add(math.NaN())
+  S.Add(math.Inf(1))
+  if S.Count != uint64(len(values)) || S.Min != -1000 || S.Max != 9000 {
+    t.Fatalf("count %d min %v max %v", S.Count, S.Min, S.Max)
+  }
+  for _, q := range([]float64{0, 0.05, 0.1, 0.5, 0.9, 0.99, 1}) {
+    want := values[int(q * float64(len(values)-1))]
+    got := S.Quantile(q)
+    if math.Abs(got - want) > SKETCH_ACCURACY * math.Abs(want) + 1e-9 {
+      t.Errorf("p%v: got %v, want %v", q*100, got, want)
+    }
+  }
+}
+
+// Merging the summaries of two halves gives the summary of the whole
+func TestSummaryMerge(t *testing.T) {
+  whole, a, b := new_numeric_summary(), new_numeric_summary(), new_numeric_summary()
+  for i := 0; i < 5000; i++ {
+    val := float64((i * 7919) % 100000 - 500)
+    whole.Add(val)
+    if i % 3 == 0 { a.Add(val) } else { b.Add(val) }
+  }
+  merged := new_numeric_summary()
+  merged.Merge(a)
+  merged.Merge(b)
+  merged.Merge(new_numeric_summary())
+  if !reflect.DeepEqual(merged, whole) {
+    t.Errorf("merged %+v\nwhole  %+v", merged, whole)
+  }
+
+  // And survives being written out and read back
+  data, err := json.Marshal(merged)
+  if err != nil { t.Fatal(err) }
+  back := new_numeric_summary()
+  if err := json.Unmarshal(data, back); err != nil { t.Fatal(err) }
+  if !reflect.DeepEqual(back, whole) {
+    t.Errorf("read back %+v\nwant      %+v", back, whole)
+  }
+  for _, q := range([]float64{0.5, 0.9, 0.99}) {
+    if back.Quantile(q) != whole.Quantile(q) {
+      t.Errorf("p%v: %v after the round trip, %v before", q*100, back.Quantile(q), whole.Quantile(q))
+    }
+  }
+}
+
+// An empty summary is written without the infinite min / max
+func TestEmptySummaryJSON(t *testing.T) {
+  data, err := json.Marshal(new_numeric_summary())
+  if err != nil { t.Fatal(err) }
+  back := &numeric_summary{}
+  if err := json.Unmarshal(data, back); err != nil { t.Fatal(err) }
+  if back.Count != 0 || !math.IsInf(back.Min, 1) || !math.IsInf(back.Max, -1) {
+    t.Errorf("got %+v", back)
+  }
+}
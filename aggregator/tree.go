@@ -0,0 +1,210 @@
+package aggregator
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "math"
+  "sort"
+  "strconv"
+)
+
+// Prefix a bucket is written under when a sub-map has the same name, e.g.
+// "foo": "a" in one submission and "foo": {"a": 1} in another
+const BUCKET_ESCAPE = "__bucket__:"
+
+// One level of the stats tree: the sub-maps below it and the bucket
+// counts kept at this level. A name can be both without either
+// overwriting the other.
+type StatsNode struct{
+  Children map[string]*StatsNode
+  Buckets map[string]uint64
+}
+
+// Bucket counts of an Output, serialized as the nested JSON object the
+// stats files have always had. Keys and bucket labels are interned, so
+// every "name" or "true" in the tree shares one string instead of keeping
+// a copy from each submission that added it.
+type StatsTree struct{
+  StatsNode
+  keys map[string]string
+}
+
+func NewStatsTree() *StatsTree {
+  return &StatsTree{keys: make(map[string]string)}
+}
+
+func (T *StatsTree) intern(s string) string {
+  if T.keys == nil { T.keys = make(map[string]string) }
+  if k, ok := T.keys[s]; ok { return k }
+  T.keys[s] = s
+  return s
+}
+
+// Forget an interned string that is no longer counted (evicted by a
+// cardinality cap). Anywhere else still using it keeps its copy, a later
+// add of the same string just interns a new one.
+func (T *StatsTree) unintern(s string) {
+  delete(T.keys, s)
+}
+
+// Sub-map of N under key, created if it doesn't exist yet
+func (T *StatsTree) child(N *StatsNode, key string) *StatsNode {
+  if C, ok := N.Children[key]; ok { return C }
+  if N.Children == nil { N.Children = make(map[string]*StatsNode) }
+  C := &StatsNode{}
+  N.Children[T.intern(key)] = C
+  return C
+}
+
+// Add num to the count of a bucket of N
+func (T *StatsTree) add(N *StatsNode, label string, num uint64) {
+  if _, ok := N.Buckets[label]; ok {
+    N.Buckets[label] += num
+    return
+  }
+  if N.Buckets == nil { N.Buckets = make(map[string]uint64) }
+  N.Buckets[T.intern(label)] = num
+}
+
+func (N *StatsNode) empty() bool {
+  return len(N.Children) == 0 && len(N.Buckets) == 0
+}
+
+// Walk down the tree to the node for a list of keys (see StatsKeys), nil
+// if there isn't one
+func (T *StatsTree) Lookup(keys []string) *StatsNode {
+  if T == nil { return nil }
+  N := &T.StatsNode
+  for _, key := range(keys) {
+    N = N.Children[key]
+    if N == nil { return nil }
+  }
+  return N
+}
+
+// Names of a node's buckets and sub-maps, sorted and without repeats
+func (N *StatsNode) names() []string {
+  names := make([]string, 0, len(N.Children) + len(N.Buckets))
+  for name := range(N.Buckets) { names = append(names, name) }
+  for name := range(N.Children) {
+    if _, ok := N.Buckets[name]; !ok { names = append(names, name) }
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Call fn for every bucket count in key order, with the dotted path of
+// the sub-maps leading to it
+func (T *StatsTree) Walk(fn func(path string, value string, count uint64)) {
+  if T == nil { return }
+  T.StatsNode.walk("", fn)
+}
+
+func (N *StatsNode) walk(prefix string, fn func(path string, value string, count uint64)) {
+  for _, name := range(N.names()) {
+    if num, ok := N.Buckets[name]; ok { fn(prefix, name, num) }
+    if C, ok := N.Children[name]; ok {
+      path := name
+      if prefix != "" { path = prefix + "." + name }
+      C.walk(path, fn)
+    }
+  }
+}
+
+// Add every count in src into T
+func (T *StatsTree) Merge(src *StatsTree) {
+  if src == nil { return }
+  T.merge_node(&T.StatsNode, &src.StatsNode)
+}
+
+func (T *StatsTree) merge_node(dst *StatsNode, src *StatsNode) {
+  for label, num := range(src.Buckets) { T.add(dst, label, num) }
+  for key, C := range(src.Children) { T.merge_node(T.child(dst, key), C) }
+}
+
+func (T *StatsTree) MarshalJSON() ([]byte, error) {
+  var buf bytes.Buffer
+  if err := T.StatsNode.write_json(&buf); err != nil { return nil, err }
+  return buf.Bytes(), nil
+}
+
+func (N *StatsNode) write_json(buf *bytes.Buffer) error {
+  buf.WriteByte('{')
+  first := true
+  write_key := func(key string) error {
+    if !first { buf.WriteByte(',') }
+    first = false
+    data, err := json.Marshal(key)
+    if err != nil { return err }
+    buf.Write(data)
+    buf.WriteByte(':')
+    return nil
+  }
+  for _, name := range(N.names()) {
+    C, ischild := N.Children[name]
+    if num, ok := N.Buckets[name]; ok {
+      key := name
+      if ischild { key = BUCKET_ESCAPE + name }
+      if err := write_key(key); err != nil { return err }
+      buf.WriteString(strconv.FormatUint(num, 10))
+    }
+    if ischild {
+      if err := write_key(name); err != nil { return err }
+      if err := C.write_json(buf); err != nil { return err }
+    }
+  }
+  buf.WriteByte('}')
+  return nil
+}
+
+func (T *StatsTree) UnmarshalJSON(data []byte) error {
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.UseNumber()
+  tok, err := decoder.Token()
+  if err != nil { return err }
+  *T = StatsTree{keys: make(map[string]string)}
+  if tok == nil { return nil }
+  if tok != json.Delim('{') { return errors.New("stats: expected an object") }
+  return T.read_node(decoder, &T.StatsNode)
+}
+
+// Read the rest of an object whose '{' was already consumed: numbers are
+// bucket counts, objects are sub-maps
+func (T *StatsTree) read_node(decoder *json.Decoder, N *StatsNode) error {
+  for decoder.More() {
+    tok, err := decoder.Token()
+    if err != nil { return err }
+    key, _ := tok.(string)
+    tok, err = decoder.Token()
+    if err != nil { return err }
+    switch v := tok.(type) {
+      case json.Number:
+        num, err := parse_count(v)
+        if err != nil { return fmt.Errorf("stats: %s: %v", key, err) }
+        if len(key) > len(BUCKET_ESCAPE) && key[:len(BUCKET_ESCAPE)] == BUCKET_ESCAPE {
+          key = key[len(BUCKET_ESCAPE):]
+        }
+        T.add(N, key, num)
+      case json.Delim:
+        if v != '{' { return fmt.Errorf("stats: %s: unexpected %v", key, v) }
+        if err := T.read_node(decoder, T.child(N, key)); err != nil { return err }
+      default:
+        return fmt.Errorf("stats: %s: unexpected value %v", key, v)
+    }
+  }
+  // The closing '}'
+  _, err := decoder.Token()
+  return err
+}
+
+// Counts were floats before the tree existed, they are whole numbers all
+// the same
+func parse_count(n json.Number) (uint64, error) {
+  if num, err := strconv.ParseUint(string(n), 10, 64); err == nil { return num, nil }
+  f, err := n.Float64()
+  if err != nil { return 0, err }
+  if f < 0 { return 0, errors.New("negative count") }
+  return uint64(math.Round(f)), nil
+}
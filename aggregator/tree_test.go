@@ -0,0 +1,99 @@
+package aggregator
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "testing"
+)
+
+// A name that is both a bucket and a sub-map is written with the bucket
+// escaped and read back into the same tree
+func TestStatsTreeEscapeRoundTrip(t *testing.T) {
+  A, _ := New(Config{})
+  for i, payload := range([]string{
+    `{"system_hash": "a", "platform": "FreeNAS", "foo": "a"}`,
+    `{"system_hash": "b", "platform": "FreeNAS", "foo": {"a": 1}}`,
+    `{"system_hash": "c", "platform": "FreeNAS", "foo": {"a": {"b": true}}, "bar": null}`,
+  }) {
+    if err := A.Add(decode(t, payload), Meta{IP: fmt.Sprintf("1.2.3.%d", i)}); err != nil { t.Fatal(err) }
+  }
+  tree := A.Daily[""].Stats
+  data, err := json.Marshal(tree)
+  if err != nil { t.Fatal(err) }
+  want := `{"bar":{"` + NULL_BUCKET + `":1},"foo":{"` + BUCKET_ESCAPE + `a":1,"a":{"1":1,"b":{"true":1}}},"platform":{"FreeNAS":3}}`
+  if string(data) != want {
+    t.Errorf("got  %s\nwant %s", data, want)
+  }
+
+  back := NewStatsTree()
+  if err := json.Unmarshal(data, back); err != nil { t.Fatal(err) }
+  again, _ := json.Marshal(back)
+  if string(again) != string(data) {
+    t.Errorf("round trip changed the tree:\n%s\n%s", data, again)
+  }
+  if N := back.Lookup([]string{"foo"}); N == nil || N.Buckets["a"] != 1 || N.Children["a"] == nil {
+    t.Errorf("bucket and sub-map a not both read back: %+v", N)
+  }
+}
+
+// Counts from files written before the tree (floats) still load
+func TestStatsTreeFloatCounts(t *testing.T) {
+  tree := NewStatsTree()
+  if err := json.Unmarshal([]byte(`{"x": {"y": 3.0, "z": 2}}`), tree); err != nil { t.Fatal(err) }
+  if N := tree.Lookup([]string{"x"}); N == nil || N.Buckets["y"] != 3 || N.Buckets["z"] != 2 {
+    t.Errorf("got %+v", N)
+  }
+  if err := json.Unmarshal([]byte(`{"x": -1}`), tree); err == nil {
+    t.Error("negative count accepted")
+  }
+}
+
+// Values evicted by a cap don't stay interned
+func TestCappedInternBounded(t *testing.T) {
+  A, _ := New(Config{Cardinality: []CardinalityRule{{Path: "model", Limit: 10}}})
+  for i := 0; i < 5000; i++ {
+    payload := fmt.Sprintf(`{"system_hash": "h%d", "platform": "FreeNAS", "model": "m%d"}`, i, i)
+    A.Add(decode(t, payload), Meta{IP: "1.2.3.4"})
+  }
+  if n := len(A.Daily[""].Stats.keys); n > 100 {
+    t.Errorf("%d strings interned for 10 kept values", n)
+  }
+}
+
+func load_submit(b *testing.B) map[string]interface{} {
+  dat, err := ioutil.ReadFile("../submit.json")
+  if err != nil { b.Skip("no submit.json:", err) }
+  return decode(b, string(dat))
+}
+
+// Counting submit.json shaped payloads, every one from a new system
+func BenchmarkAdd(b *testing.B) {
+  inputs := load_submit(b)
+  A, _ := New(Config{})
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    inputs["system_hash"] = fmt.Sprintf("bench-%d", i)
+    if err := A.Add(inputs, Meta{Country: "US", IP: "8.8.8.8"}); err != nil { b.Fatal(err) }
+  }
+}
+
+// Writing and reading back the stats of a day of submit.json payloads
+func BenchmarkStatsJSON(b *testing.B) {
+  inputs := load_submit(b)
+  A, _ := New(Config{})
+  for i := 0; i < 1000; i++ {
+    inputs["system_hash"] = fmt.Sprintf("bench-%d", i)
+    A.Add(inputs, Meta{Country: "US", IP: "8.8.8.8"})
+  }
+  out := A.Daily[""]
+  b.ReportAllocs()
+  b.ResetTimer()
+  for i := 0; i < b.N; i++ {
+    data, err := json.Marshal(out)
+    if err != nil { b.Fatal(err) }
+    var back Output
+    if err := json.Unmarshal(data, &back); err != nil { b.Fatal(err) }
+  }
+}
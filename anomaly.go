@@ -0,0 +1,413 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "io/ioutil"
+  "log"
+  "math"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+// Settings for spotting unusual submission volumes
+type anomaly_config struct{
+  Enabled bool `json:"enabled"`
+  // Days of history each hour / day is compared against (default 7)
+  BaselineDays int `json:"baseline_days"`
+  // Volumes where neither the count nor the baseline reach this are
+  // too small to judge (default 20)
+  MinCount float64 `json:"min_count"`
+  // Flag a count at or below this fraction of the baseline (default 0.5)
+  Drop float64 `json:"drop"`
+  // Flag a count at or above this multiple of the baseline (default 2)
+  Spike float64 `json:"spike"`
+  // Where events are appended (default SDIR/anomalies.jsonl)
+  EventsFile string `json:"events_file"`
+}
+
+// A count also has to be this many standard deviations from the baseline,
+// so noisy series don't raise events on every wobble
+const ANOMALY_MIN_SCORE = 3
+
+// Events kept in memory for /status
+const ANOMALY_RECENT = 100
+
+// Anomaly settings with the defaults filled in
+func anomaly_settings(conf anomaly_config) anomaly_config {
+  if conf.BaselineDays < 1 { conf.BaselineDays = 7 }
+  if conf.MinCount <= 0 { conf.MinCount = 20 }
+  if conf.Drop <= 0 || conf.Drop >= 1 { conf.Drop = 0.5 }
+  if conf.Spike <= 1 { conf.Spike = 2 }
+  if conf.EventsFile == "" { conf.EventsFile = SDIR + "/anomalies.jsonl" }
+  return conf
+}
+
+// One hour or day where a series was far off its baseline
+type anomaly_event struct{
+  Detected string `json:"detected"`
+  // "hour" or "day"
+  Window string `json:"window"`
+  // "2006-01-02T15" for an hour, "2006-01-02" for a day
+  Period string `json:"period"`
+  // "segment" (ALL, CORE, ...) or "country"
+  Dimension string `json:"dimension"`
+  Key string `json:"key"`
+  // "drop" or "spike"
+  Kind string `json:"kind"`
+  Count float64 `json:"count"`
+  Baseline float64 `json:"baseline"`
+  Ratio float64 `json:"ratio"`
+  Score float64 `json:"score"`
+}
+
+// Submission counts per series ("segment/CORE", "country/US") for every
+// hour and day in the baseline window. An hour or day is only in the maps
+// if the collector was running for it, and hours / days it was only
+// running for part of are marked partial, so downtime doesn't look like
+// a drop.
+type volume_tracker struct{
+  lock sync.Mutex
+  Hour string `json:"hour"`
+  Hours map[string]map[string]float64 `json:"hours"`
+  Days map[string]map[string]float64 `json:"days"`
+  Partial map[string]bool `json:"partial"`
+  recent []anomaly_event
+  // When catch_up was last called, stamped on the events it finds
+  now time.Time
+  // Counted by submissions without taking lock, folded in by catch_up
+  pending [VOLUME_SHARDS]volume_pending
+  next uint32
+}
+
+// Submissions go round-robin over this many pending counters
+const VOLUME_SHARDS = 16
+
+// Counts per hour and series not yet folded into the tracker
+type volume_pending struct{
+  lock sync.Mutex
+  counts map[string]map[string]float64
+}
+
+var VOLUME = &volume_tracker{}
+
+const HOUR_LAYOUT = "2006-01-02T15"
+
+func volume_file() string {
+  return SDIR + "/volume.json"
+}
+
+// Count one submission at t. Only one of the pending shards is locked,
+// the hour is judged and saved later by catch_up.
+func (V *volume_tracker) record(t time.Time, segment string, country string) {
+  hour := t.Format(HOUR_LAYOUT)
+  P := &V.pending[atomic.AddUint32(&V.next, 1) % VOLUME_SHARDS]
+  P.lock.Lock()
+  defer P.lock.Unlock()
+  if P.counts == nil { P.counts = make(map[string]map[string]float64) }
+  M := P.counts[hour]
+  if M == nil {
+    M = make(map[string]float64)
+    P.counts[hour] = M
+  }
+  for _, key := range(volume_keys(segment, country)) { M[key]++ }
+}
+
+// Fold the pending counts in, hour by hour so each hour is judged with
+// everything counted in it, then move the current hour up to t. Caller
+// holds V.lock.
+func (V *volume_tracker) catch_up(t time.Time, conf anomaly_config) {
+  V.now = t
+  pending := make(map[string]map[string]float64)
+  for i := range(V.pending) {
+    P := &V.pending[i]
+    P.lock.Lock()
+    counts := P.counts
+    P.counts = nil
+    P.lock.Unlock()
+    for hour, M := range(counts) {
+      if pending[hour] == nil { pending[hour] = make(map[string]float64) }
+      for key, num := range(M) { pending[hour][key] += num }
+    }
+  }
+  hours := make([]string, 0, len(pending))
+  for hour := range(pending) { hours = append(hours, hour) }
+  sort.Strings(hours)
+  for _, hour := range(hours) {
+    if hour > V.Hour {
+      if ht, err := time.ParseInLocation(HOUR_LAYOUT, hour, t.Location()); err == nil { V.advance(ht, conf) }
+    }
+    // Anything counted in an hour already judged just adds to its totals
+    if V.Hours[hour] == nil { V.Hours[hour] = make(map[string]float64) }
+    if V.Days[hour[:10]] == nil { V.Days[hour[:10]] = make(map[string]float64) }
+    for key, num := range(pending[hour]) {
+      V.Hours[hour][key] += num
+      V.Days[hour[:10]][key] += num
+    }
+  }
+  V.advance(t, conf)
+}
+
+func volume_keys(segment string, country string) []string {
+  keys := []string{"segment/ALL"}
+  if segment != "" { keys = append(keys, "segment/" + segment) }
+  if country != "" { keys = append(keys, "country/" + country) }
+  return keys
+}
+
+// Move the current hour up to t, judging every hour (and day) that closed
+// on the way. Caller holds V.lock.
+func (V *volume_tracker) advance(t time.Time, conf anomaly_config) {
+  hour := t.Format(HOUR_LAYOUT)
+  if V.Hours == nil { V.Hours = make(map[string]map[string]float64) }
+  if V.Days == nil { V.Days = make(map[string]map[string]float64) }
+  if V.Partial == nil { V.Partial = make(map[string]bool) }
+  if hour == V.Hour { return }
+  var events []anomaly_event
+  if V.Hour == "" {
+    // Only counting from now on
+    V.Partial[hour] = true
+    V.Partial[hour[:10]] = true
+  } else if V.Hour < hour {
+    events = append(events, V.judge("hour", V.Hour, V.Hours, hour_baseline(V.Hour, conf.BaselineDays), conf)...)
+    if V.Hour[:10] != hour[:10] {
+      events = append(events, V.judge("day", V.Hour[:10], V.Days, day_baseline(V.Hour[:10], conf.BaselineDays), conf)...)
+    }
+  }
+  V.Hour = hour
+  if V.Hours[hour] == nil { V.Hours[hour] = make(map[string]float64) }
+  if V.Days[hour[:10]] == nil { V.Days[hour[:10]] = make(map[string]float64) }
+  V.prune(t, conf.BaselineDays)
+  if err := V.save(); err != nil {
+    log.Println("Failed saving submission volumes:", err)
+  }
+  if len(events) > 0 {
+    record_anomalies(events, conf)
+    V.recent = append(V.recent, events...)
+    if len(V.recent) > ANOMALY_RECENT { V.recent = V.recent[len(V.recent) - ANOMALY_RECENT:] }
+  }
+}
+
+// The same hour of day on each of the previous days
+func hour_baseline(hour string, days int) []string {
+  t, err := time.Parse(HOUR_LAYOUT, hour)
+  if err != nil { return nil }
+  var out []string
+  for i := 1; i <= days; i++ {
+    out = append(out, t.AddDate(0, 0, -i).Format(HOUR_LAYOUT))
+  }
+  return out
+}
+
+// The previous days
+func day_baseline(day string, days int) []string {
+  t, err := time.Parse("2006-01-02", day)
+  if err != nil { return nil }
+  var out []string
+  for i := 1; i <= days; i++ {
+    out = append(out, t.AddDate(0, 0, -i).Format("2006-01-02"))
+  }
+  return out
+}
+
+// Compare every series in a closed period against the same series in the
+// baseline periods that were recorded
+func (V *volume_tracker) judge(window string, period string, counts map[string]map[string]float64, baseline []string, conf anomaly_config) []anomaly_event {
+  if V.Partial[period] { return nil }
+  var samples []map[string]float64
+  for _, b := range(baseline) {
+    if M, ok := counts[b]; ok && !V.Partial[b] { samples = append(samples, M) }
+  }
+  // Too little history to say what normal is
+  if len(samples) < 3 { return nil }
+  keys := make(map[string]bool)
+  for key := range(counts[period]) { keys[key] = true }
+  for _, M := range(samples) {
+    for key := range(M) { keys[key] = true }
+  }
+  now := V.now.Format(time.RFC3339)
+  var events []anomaly_event
+  for key := range(keys) {
+    mean, variance := 0.0, 0.0
+    for _, M := range(samples) { mean += M[key] }
+    mean /= float64(len(samples))
+    for _, M := range(samples) { variance += (M[key] - mean) * (M[key] - mean) }
+    variance /= float64(len(samples))
+    count := counts[period][key]
+    if count < conf.MinCount && mean < conf.MinCount { continue }
+    // Counts are at least as noisy as a Poisson process
+    score := (count - mean) / math.Sqrt(math.Max(math.Max(variance, mean), 1))
+    kind := ""
+    if count <= mean * conf.Drop && score <= -ANOMALY_MIN_SCORE {
+      kind = "drop"
+    } else if count >= mean * conf.Spike && score >= ANOMALY_MIN_SCORE {
+      kind = "spike"
+    }
+    if kind == "" { continue }
+    ratio := 0.0
+    if mean > 0 { ratio = count / mean }
+    dim := strings.SplitN(key, "/", 2)
+    events = append(events, anomaly_event{
+      Detected: now, Window: window, Period: period, Dimension: dim[0], Key: dim[1],
+      Kind: kind, Count: count, Baseline: math.Round(mean * 100) / 100,
+      Ratio: math.Round(ratio * 100) / 100, Score: math.Round(score * 100) / 100,
+    })
+  }
+  sort.Slice(events, func(i, j int) bool {
+    if events[i].Dimension != events[j].Dimension { return events[i].Dimension > events[j].Dimension }
+    return events[i].Key < events[j].Key
+  })
+  return events
+}
+
+// Forget hours and days that have dropped out of every baseline
+func (V *volume_tracker) prune(t time.Time, days int) {
+  oldest := t.AddDate(0, 0, -days - 1)
+  for hour := range(V.Hours) {
+    if hour < oldest.Format(HOUR_LAYOUT) { delete(V.Hours, hour) }
+  }
+  for day := range(V.Days) {
+    if day < oldest.Format("2006-01-02") { delete(V.Days, day) }
+  }
+  for period := range(V.Partial) {
+    if period < oldest.Format("2006-01-02") { delete(V.Partial, period) }
+  }
+}
+
+// Write the counts so far, at shutdown. Caller holds wlock.
+func (V *volume_tracker) flush(conf anomaly_config) error {
+  V.lock.Lock()
+  defer V.lock.Unlock()
+  if conf.Enabled { V.catch_up(period_now(), conf) }
+  if V.Hour == "" { return nil }
+  return V.save()
+}
+
+// Keep the history across restarts, caller holds V.lock
+func (V *volume_tracker) save() error {
+  file, err := json.Marshal(V)
+  if err != nil { return err }
+  return write_file_atomic(volume_file(), file)
+}
+
+// Read back the history and the latest events
+func (V *volume_tracker) load(conf anomaly_config) {
+  V.lock.Lock()
+  defer V.lock.Unlock()
+  if dat, err := ioutil.ReadFile(volume_file()); err == nil {
+    if err := json.Unmarshal(dat, V); err != nil {
+      log.Println("Failed loading submission volumes:", err)
+    }
+  }
+  // Picking up where we left off only works within the same hour,
+  // otherwise the hour we stopped in was cut short and so was its day
+  // if that isn't over yet
+  if now := period_now().Format(HOUR_LAYOUT); V.Hour != "" && V.Hour != now {
+    if V.Partial == nil { V.Partial = make(map[string]bool) }
+    V.Partial[V.Hour] = true
+    V.Partial[V.Hour[:10]] = true
+    V.Hour = ""
+  }
+  V.recent = nil
+  file, err := os.Open(conf.EventsFile)
+  if err != nil { return }
+  defer file.Close()
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    var event anomaly_event
+    if json.Unmarshal(scanner.Bytes(), &event) != nil { continue }
+    V.recent = append(V.recent, event)
+    if len(V.recent) > ANOMALY_RECENT { V.recent = V.recent[1:] }
+  }
+}
+
+// Append events to the events file and the log
+func record_anomalies(events []anomaly_event, conf anomaly_config) {
+  file, err := os.OpenFile(conf.EventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    log.Println("Failed writing anomaly events:", err)
+  }
+  for _, event := range(events) {
+    log.Printf("Anomaly: %s %s/%s %s: %.0f submissions, baseline %.1f\n", event.Kind, event.Dimension, event.Key, event.Period, event.Count, event.Baseline)
+    if file == nil { continue }
+    line, _ := json.Marshal(event)
+    file.Write(append(line, '\n'))
+  }
+  if file != nil { file.Close() }
+}
+
+// Close hours on time even when nothing is being submitted, which is
+// when a drop matters most
+func anomaly_loop() {
+  defer WORKERS.Done()
+  ticker := time.NewTicker(time.Minute)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-STOP:
+      return
+    case <-ticker.C:
+    }
+    wlock.RLock()
+    conf := anomaly_settings(CONFIG.Anomaly)
+    now := period_now()
+    wlock.RUnlock()
+    if !conf.Enabled { continue }
+    VOLUME.lock.Lock()
+    VOLUME.catch_up(now, conf)
+    VOLUME.lock.Unlock()
+  }
+}
+
+type status_json struct{
+  DailyPeriod string `json:"daily_period"`
+  MonthlyPeriod string `json:"monthly_period"`
+  // Submissions counted since the last flush
+  Unflushed int64 `json:"unflushed"`
+  Shards int `json:"shards"`
+  AnomalyDetection bool `json:"anomaly_detection"`
+  // Submissions so far this hour and day, per series
+  Hour map[string]float64 `json:"hour,omitempty"`
+  Day map[string]float64 `json:"day,omitempty"`
+  // Latest anomaly events, oldest first
+  Anomalies []anomaly_event `json:"anomalies"`
+}
+
+// GET /status
+func read_status(rw http.ResponseWriter, req *http.Request) {
+  if req.Method != "GET" {
+    http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  wlock.RLock()
+  status := status_json{
+    DailyPeriod: DAILYPERIOD,
+    MonthlyPeriod: MONTHLYPERIOD,
+    Unflushed: atomic.LoadInt64(&WCOUNTER),
+    Shards: AGGREGATOR.Shards(),
+    AnomalyDetection: CONFIG.Anomaly.Enabled,
+  }
+  conf := anomaly_settings(CONFIG.Anomaly)
+  now := period_now()
+  wlock.RUnlock()
+  VOLUME.lock.Lock()
+  if conf.Enabled { VOLUME.catch_up(now, conf) }
+  if VOLUME.Hour != "" {
+    status.Hour = VOLUME.Hours[VOLUME.Hour]
+    status.Day = VOLUME.Days[VOLUME.Hour[:10]]
+  }
+  status.Anomalies = append([]anomaly_event{}, VOLUME.recent...)
+  body, err := json.Marshal(status)
+  VOLUME.lock.Unlock()
+  if err != nil {
+    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  rw.Header().Set("Content-Type", "application/json")
+  rw.Write(body)
+}
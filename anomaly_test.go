@@ -0,0 +1,54 @@
+package main
+
+import (
+  "testing"
+  "time"
+)
+
+// A tracker with three full days of history at 100 submissions an hour
+func volume_history(t *testing.T, day time.Time) *volume_tracker {
+  SDIR = t.TempDir()
+  V := &volume_tracker{
+    Hours: make(map[string]map[string]float64),
+    Days: make(map[string]map[string]float64),
+    Partial: make(map[string]bool),
+  }
+  for i := 1; i <= 3; i++ {
+    for h := 0; h < 24; h++ {
+      hour := day.AddDate(0, 0, -i).Add(time.Duration(h) * time.Hour).Format(HOUR_LAYOUT)
+      V.Hours[hour] = map[string]float64{"segment/ALL": 100}
+    }
+    V.Days[day.AddDate(0, 0, -i).Format("2006-01-02")] = map[string]float64{"segment/ALL": 2400}
+  }
+  // Counting since the start of the hour before
+  V.Hour = day.Add(9 * time.Hour).Format(HOUR_LAYOUT)
+  V.Hours[V.Hour] = make(map[string]float64)
+  V.Days[V.Hour[:10]] = make(map[string]float64)
+  return V
+}
+
+func TestVolumeCatchUp(t *testing.T) {
+  day := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+  conf := anomaly_settings(anomaly_config{Enabled: true})
+  for _, c := range([]struct{
+    count int
+    events int
+  }{{100, 0}, {10, 1}, {300, 1}}) {
+    V := volume_history(t, day)
+    conf.EventsFile = SDIR + "/anomalies.jsonl"
+    // Counted in 09:00-10:00 but only folded in after 10:00
+    for i := 0; i < c.count; i++ {
+      V.record(day.Add(9*time.Hour + time.Duration(i) * time.Second), "", "")
+    }
+    V.catch_up(day.Add(10*time.Hour + 30*time.Second), conf)
+    if got := V.Hours[day.Add(9 * time.Hour).Format(HOUR_LAYOUT)]["segment/ALL"]; got != float64(c.count) {
+      t.Errorf("%d submissions: hour counted %v", c.count, got)
+    }
+    if len(V.recent) != c.events {
+      t.Errorf("%d submissions: %d events, want %d: %+v", c.count, len(V.recent), c.events, V.recent)
+    }
+    if V.Hour != day.Add(10 * time.Hour).Format(HOUR_LAYOUT) {
+      t.Errorf("current hour %s", V.Hour)
+    }
+  }
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+  "bufio"
+  "compress/gzip"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "os"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// One line of the raw archive: the submission as it arrived, before the
+// policy touched it, with what the aggregator needs to count it again
+type raw_record struct{
+  Time string `json:"time"`
+  IP string `json:"ip"`
+  Country string `json:"country"`
+  Submission map[string]interface{} `json:"submission"`
+}
+
+// Archive file currently open for appending, and its day
+var ARCHIVE *os.File
+var ARCHIVEPERIOD string
+
+func archive_dir() string {
+  return SDIR + "/raw"
+}
+
+// Append a submission to raw/<day>.jsonl. Caller must hold wlock (the
+// read side is enough, ilock serializes the writes).
+func archive_submission(inputs map[string]interface{}, ip string, country string, t time.Time) error {
+  ilock.Lock()
+  defer ilock.Unlock()
+  if ARCHIVE == nil || ARCHIVEPERIOD != DAILYPERIOD {
+    if ARCHIVE != nil { ARCHIVE.Close() }
+    ARCHIVE = nil
+    if err := os.MkdirAll(archive_dir(), 0700); err != nil { return err }
+    file, err := os.OpenFile(archive_dir()+"/"+DAILYPERIOD+".jsonl", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+    if err != nil { return err }
+    ARCHIVE = file
+    ARCHIVEPERIOD = DAILYPERIOD
+  }
+  line, err := json.Marshal(raw_record{t.In(LOCATION).Format(time.RFC3339Nano), ip, country, inputs})
+  if err != nil { return err }
+  _, err = ARCHIVE.Write(append(line, '\n'))
+  return err
+}
+
+func close_archive() {
+  ilock.Lock()
+  defer ilock.Unlock()
+  if ARCHIVE != nil {
+    ARCHIVE.Close()
+    ARCHIVE = nil
+  }
+}
+
+// Read every record archived for a day, nil if there is no archive for it.
+// Days gzipped by the retention policy are read from <day>.jsonl.gz.
+func read_archive(day string) ([]raw_record, error) {
+  path := archive_dir() + "/" + day + ".jsonl"
+  file, err := os.Open(path)
+  if os.IsNotExist(err) {
+    path += ".gz"
+    file, err = os.Open(path)
+  }
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  var reader io.Reader = file
+  if strings.HasSuffix(path, ".gz") {
+    gz, err := gzip.NewReader(file)
+    if err != nil { return nil, fmt.Errorf("%s: %v", path, err) }
+    defer gz.Close()
+    reader = gz
+  }
+  var records []raw_record
+  scanner := bufio.NewScanner(reader)
+  scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+  for line := 1; scanner.Scan(); line++ {
+    var rec raw_record
+    decoder := json.NewDecoder(strings.NewReader(scanner.Text()))
+    decoder.UseNumber()
+    if err := decoder.Decode(&rec); err != nil {
+      return nil, fmt.Errorf("%s.jsonl:%d: %v", day, line, err)
+    }
+    records = append(records, rec)
+  }
+  return records, scanner.Err()
+}
+
+// Days in the archive, sorted
+func archived_days() ([]string, error) {
+  names, err := ioutil.ReadDir(archive_dir())
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  seen := make(map[string]bool)
+  var days []string
+  for _, info := range(names) {
+    name := strings.TrimSuffix(info.Name(), ".gz")
+    if !strings.HasSuffix(name, ".jsonl") { continue }
+    day := strings.TrimSuffix(name, ".jsonl")
+    if _, err := time.Parse("2006-01-02", day); err == nil && !seen[day] {
+      seen[day] = true
+      days = append(days, day)
+    }
+  }
+  sort.Strings(days)
+  return days, nil
+}
+
+// The aggregates and dedup sets a flush of the current counters writes,
+// merged from every shard
+func current_batch() storage_batch {
+  snap := AGGREGATOR.Snapshot()
+  var batch storage_batch
+  for _, segment := range(SEGMENTS) {
+    batch.Aggregates = append(batch.Aggregates, storage_aggregate{DAILYPERIOD, segment, snap.Daily[segment]})
+  }
+  batch.Aggregates = append(batch.Aggregates, storage_aggregate{MONTHLYPERIOD, "", snap.Month})
+  batch.IDs = []storage_ids{
+    {DAILYPERIOD, snap.DailyIDs},
+    {MONTHLYPERIOD, snap.MonthIDs},
+  }
+  return batch
+}
+
+// Re-run the archived days from..to (inclusive) through the aggregator. Every
+// archived day of the months touched is replayed so the monthly totals are
+// complete, but only days in the range are returned.
+func reaggregate(from string, to string) (storage_batch, error) {
+  var batch storage_batch
+  days, err := archived_days()
+  if err != nil { return batch, err }
+  months := make(map[string]bool)
+  for _, day := range(days) {
+    if day >= from && day <= to { months[day[:7]] = true }
+  }
+  if len(months) == 0 {
+    return batch, fmt.Errorf("No archived submissions between %s and %s", from, to)
+  }
+  MONTHLYPERIOD = ""
+  for _, day := range(days) {
+    month := day[:7]
+    if !months[month] { continue }
+    if month != MONTHLYPERIOD {
+      if MONTHLYPERIOD != "" {
+        batch = append_month(batch)
+      }
+      AGGREGATOR.ResetMonth()
+      MONTHLYPERIOD = month
+    }
+    AGGREGATOR.ResetDay()
+    DAILYPERIOD = day
+    records, err := read_archive(day)
+    if err != nil { return batch, err }
+    for _, rec := range(records) {
+      if err := AGGREGATOR.Add(rec.Submission, aggregator.Meta{Country: rec.Country, IP: rec.IP}); err != nil {
+        log.Println(day + ":", err)
+      }
+    }
+    if day >= from && day <= to {
+      day_batch := current_batch()
+      batch.Aggregates = append(batch.Aggregates, day_batch.Aggregates[:len(SEGMENTS)]...)
+      batch.IDs = append(batch.IDs, day_batch.IDs[0])
+    }
+  }
+  return append_month(batch), nil
+}
+
+// Stored days in the months reaggregate(from, to) rebuilds that have no
+// archive. The rebuilt monthly stats would be missing them.
+func unarchived_days(from string, to string) ([]string, error) {
+  days, err := archived_days()
+  if err != nil { return nil, err }
+  archived := make(map[string]bool)
+  months := make(map[string]bool)
+  for _, day := range(days) {
+    archived[day] = true
+    if day >= from && day <= to { months[day[:7]] = true }
+  }
+  periods, err := STORAGE.Periods()
+  if err != nil { return nil, err }
+  var missing []string
+  for _, period := range(periods) {
+    if len(period) == 10 && months[period[:7]] && !archived[period] {
+      missing = append(missing, period)
+    }
+  }
+  return missing, nil
+}
+
+func append_month(batch storage_batch) storage_batch {
+  snap := AGGREGATOR.Snapshot()
+  batch.Aggregates = append(batch.Aggregates, storage_aggregate{MONTHLYPERIOD, "", snap.Month})
+  batch.IDs = append(batch.IDs, storage_ids{MONTHLYPERIOD, snap.MonthIDs})
+  return batch
+}
+
+// One line of the reaggregate summary per rebuilt aggregate
+func print_reaggregate_summary(batch storage_batch, previous storage_backend) error {
+  for _, agg := range(batch.Aggregates) {
+    name := agg.Period
+    if agg.Segment != "" { name += "-" + agg.Segment }
+    old, found, err := previous.LoadAggregate(agg.Period, agg.Segment)
+    if err != nil { return err }
+    if !found {
+      fmt.Printf("%-24s new: %d systems, %d submissions\n", name, agg.Stats.Syscount, agg.Stats.Submissions)
+      continue
+    }
+    report := diff_outputs("old", old, "new", agg.Stats, false)
+    fmt.Printf("%-24s systems %d -> %d, submissions %d -> %d, %d stat paths changed\n", name, old.Syscount, agg.Stats.Syscount, old.Submissions, agg.Stats.Submissions, len(report.Stats))
+  }
+  return nil
+}
+
+// reaggregate -from 2020-06-01 -to 2020-06-30 (-o dir | -replace)
+func reaggregate_cmd(args []string) error {
+  flags := flag.NewFlagSet("reaggregate", flag.ExitOnError)
+  from := flags.String("from", "", "First day to rebuild (2006-01-02)")
+  to := flags.String("to", "", "Last day to rebuild (default -from)")
+  outdir := flags.String("o", "", "Directory to write the rebuilt stats files to")
+  replace := flags.Bool("replace", false, "Replace the stored stats instead")
+  flags.Parse(args)
+  if *to == "" { *to = *from }
+  if *from == "" || flags.NArg() != 0 || (*outdir == "") == !*replace {
+    return errors.New("Usage: reaggregate -from 2006-01-02 [-to 2006-01-02] (-o dir | -replace)")
+  }
+  for _, day := range([]string{*from, *to}) {
+    if _, err := time.Parse("2006-01-02", day); err != nil {
+      return fmt.Errorf("Invalid day: %s", day)
+    }
+  }
+  // The running collector owns the current day and month
+  if *replace && (*to)[:7] >= period_now().Format("2006-01") {
+    return errors.New("Can't replace the current month while it is still being collected, use -o")
+  }
+
+  // Replacing a month with one rebuilt from part of its days would lose
+  // the rest, e.g. the days before archive_raw was turned on
+  missing, err := unarchived_days(*from, *to)
+  if err != nil { return err }
+  if len(missing) > 0 {
+    if *replace {
+      return fmt.Errorf("Can't replace the monthly stats, these stored days have no archive: %s", strings.Join(missing, ", "))
+    }
+    fmt.Printf("Warning: the monthly stats leave out stored days with no archive: %s\n", strings.Join(missing, ", "))
+  }
+
+  batch, err := reaggregate(*from, *to)
+  if err != nil { return err }
+  if err := print_reaggregate_summary(batch, STORAGE); err != nil { return err }
+  if *replace {
+    // One batch, so sqlite replaces everything in one transaction and
+    // the file backend swaps each file in atomically
+    return STORAGE.Save(batch)
+  }
+  if err := os.MkdirAll(*outdir, 0755); err != nil { return err }
+  out := &file_storage{dir: *outdir}
+  return out.Save(batch)
+}
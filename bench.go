@@ -0,0 +1,132 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+  "runtime"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// Something that can count submissions from many goroutines
+type bench_target interface{
+  Add(inputs map[string]interface{}, meta aggregator.Meta) error
+}
+
+// The pre-sharding path: one aggregator behind one lock
+type locked_aggregator struct{
+  lock sync.Mutex
+  agg *aggregator.Aggregator
+}
+
+func (L *locked_aggregator) Add(inputs map[string]interface{}, meta aggregator.Meta) error {
+  L.lock.Lock()
+  defer L.lock.Unlock()
+  return L.agg.Add(inputs, meta)
+}
+
+// Read the payloads to replay, decoded the way submit does
+func read_bench_payloads(paths []string) ([]map[string]interface{}, error) {
+  var payloads []map[string]interface{}
+  for _, path := range(paths) {
+    file, err := os.Open(path)
+    if err != nil { return nil, err }
+    var s map[string]interface{}
+    decoder := json.NewDecoder(file)
+    decoder.UseNumber()
+    err = decoder.Decode(&s)
+    file.Close()
+    if err != nil { return nil, fmt.Errorf("%s: %v", path, err) }
+    payloads = append(payloads, s)
+  }
+  return payloads, nil
+}
+
+type bench_result struct{
+  Elapsed time.Duration
+  Allocs uint64
+  Bytes uint64
+  // Heap still in use once the run is over, i.e. the counters themselves
+  Retained int64
+}
+
+// Count n submissions with the given number of workers, every one a
+// different system
+func run_bench(target bench_target, payloads []map[string]interface{}, n int, workers int) bench_result {
+  runtime.GC()
+  var before, after runtime.MemStats
+  runtime.ReadMemStats(&before)
+  var next int64 = -1
+  var wg sync.WaitGroup
+  start := time.Now()
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for {
+        i := atomic.AddInt64(&next, 1)
+        if i >= int64(n) { return }
+        src := payloads[i % int64(len(payloads))]
+        inputs := make(map[string]interface{}, len(src))
+        for key, val := range(src) { inputs[key] = val }
+        inputs["system_hash"] = fmt.Sprintf("bench-%d", i)
+        target.Add(inputs, aggregator.Meta{Country: "US", IP: "8.8.8.8"})
+      }
+    }()
+  }
+  wg.Wait()
+  elapsed := time.Since(start)
+  runtime.ReadMemStats(&after)
+  res := bench_result{elapsed, after.Mallocs - before.Mallocs, after.TotalAlloc - before.TotalAlloc, 0}
+  runtime.GC()
+  runtime.ReadMemStats(&after)
+  res.Retained = int64(after.HeapAlloc) - int64(before.HeapAlloc)
+  runtime.KeepAlive(target)
+  return res
+}
+
+func print_bench(name string, res bench_result, n int) {
+  fmt.Printf("%-28s %10.0f submissions/s %10d ns/op %8d allocs/op %9d B/op %8d KB retained\n", name,
+    float64(n) / res.Elapsed.Seconds(), res.Elapsed.Nanoseconds() / int64(n),
+    res.Allocs / uint64(n), res.Bytes / uint64(n), res.Retained / 1024)
+}
+
+// bench [-n count] [-workers N] [-shards N] submit.json ...
+func bench_cmd(args []string) error {
+  flags := flag.NewFlagSet("bench", flag.ExitOnError)
+  n := flags.Int("n", 100000, "Submissions to count per run")
+  workers := flags.Int("workers", runtime.NumCPU(), "Goroutines submitting at once")
+  shards := flags.Int("shards", shard_count(), "Shards for the sharded aggregator")
+  flags.Parse(args)
+  if flags.NArg() == 0 || *n < 1 || *workers < 1 {
+    return errors.New("Usage: bench [-n count] [-workers N] [-shards N] submit.json ...")
+  }
+  payloads, err := read_bench_payloads(flags.Args())
+  if err != nil { return err }
+  fmt.Printf("%d submissions, %d workers, %d shards, GOMAXPROCS %d\n", *n, *workers, *shards, runtime.GOMAXPROCS(0))
+
+  single, err := aggregator.New(aggregator_config())
+  if err != nil { return err }
+  locked := run_bench(&locked_aggregator{agg: single}, payloads, *n, *workers)
+  print_bench("single lock", locked, *n)
+
+  sharded, err := aggregator.NewSharded(aggregator_config(), *shards)
+  if err != nil { return err }
+  res := run_bench(sharded, payloads, *n, *workers)
+  print_bench(fmt.Sprintf("sharded (%d shards)", *shards), res, *n)
+
+  start := time.Now()
+  snap := sharded.Snapshot()
+  fmt.Printf("%-28s %10s\n", "snapshot (merge shards)", time.Since(start).Round(time.Microsecond))
+  if snap.Daily[""].Submissions != uint(*n) {
+    return fmt.Errorf("Sharded snapshot counted %d submissions, expected %d", snap.Daily[""].Submissions, *n)
+  }
+  fmt.Printf("speedup %.2fx\n", locked.Elapsed.Seconds() / res.Elapsed.Seconds())
+  return nil
+}
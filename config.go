@@ -0,0 +1,148 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "log"
+  "os"
+  "runtime"
+  "time"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// Where to look for the collector settings
+var CONFIGFILE = "/usr/local/etc/usage-collector.json"
+
+type config_json struct{
+  // Seconds between background flushes of dirty counters (0 disables)
+  FlushInterval int `json:"flush_interval"`
+  // Number of submissions before a flush is forced
+  FlushThreshold int `json:"flush_threshold"`
+  // GeoIP country database
+  GeoIPFile string `json:"geoip_db"`
+  // Bearer token for the /admin API (empty disables it)
+  AdminToken string `json:"admin_token"`
+  // Timezone that day / month boundaries are calculated in
+  Timezone string `json:"timezone"`
+  // Storage backend: "file" (JSON files in SDIR) or "sqlite"
+  Storage string `json:"storage"`
+  // SQLite database for the sqlite backend (default SDIR/stats.db)
+  SQLiteFile string `json:"sqlite_db"`
+  // JSON file of bucketing rules for numeric fields
+  BucketRules string `json:"bucket_rules"`
+  // Field allow / deny lists, scrubbing and hashing
+  Policy aggregator.Policy `json:"policy"`
+  // Caps on the number of distinct string values kept per path
+  Cardinality []aggregator.CardinalityRule `json:"cardinality"`
+  // How the elements of each array of objects are keyed
+  ArrayKeys []aggregator.ArrayKeyRule `json:"array_keys"`
+  // Pairs of dimensions counted against each other, e.g. country by platform
+  Crosstabs []aggregator.CrosstabRule `json:"crosstabs"`
+  // Outputs also written as flat dotted-path files: "ALL", "CORE",
+  // "ENTERPRISE", "SCALE", "INTERNAL" or "MONTH"
+  FlatOutputs []string `json:"flat_outputs"`
+  // Static HTML site re-rendered whenever a period closes (empty disables)
+  RenderDir string `json:"render_dir"`
+  // Keep every raw submission in SDIR/raw for reaggregate. The archive is
+  // written before the policy runs, so it holds the fields the policy
+  // drops or scrubs and every client IP address.
+  ArchiveRaw bool `json:"archive_raw"`
+  // Aggregator shards counting submissions in parallel (0 for one per CPU)
+  Shards int `json:"shards"`
+  // Compression and deletion of old period files
+  Retention retention_config `json:"retention"`
+  // Watching submission volumes for sudden drops and spikes
+  Anomaly anomaly_config `json:"anomaly"`
+  // URLs told about every closed day and month
+  Webhooks webhook_config `json:"webhooks"`
+}
+var CONFIG config_json
+
+// Rules loaded from CONFIG.BucketRules
+var BUCKET_RULES []aggregator.BucketRule
+
+// Location built from CONFIG.Timezone
+var LOCATION = time.UTC
+
+// Settings used when the config file is missing or leaves a field unset
+func default_config() config_json {
+  return config_json{
+    FlushInterval: 300,
+    FlushThreshold: 100,
+    GeoIPFile: "/var/db/GeoLite2-Country.mmdb",
+    Timezone: "UTC",
+    Storage: "file",
+  }
+}
+
+// Read the config file over the top of the defaults
+func load_config() error {
+  conf := default_config()
+  if path := os.Getenv("USAGE_COLLECTOR_CONFIG") ; path != "" {
+    CONFIGFILE = path
+  }
+  dat, err := ioutil.ReadFile(CONFIGFILE)
+  if err != nil {
+    if os.IsNotExist(err) {
+      CONFIG = conf
+      LOCATION = time.UTC
+      BUCKET_RULES = nil
+      return nil
+    }
+    return err
+  }
+  if err := json.Unmarshal(dat, &conf); err != nil {
+    return err
+  }
+  if conf.FlushThreshold < 1 {
+    log.Println("Invalid flush_threshold, using default")
+    conf.FlushThreshold = default_config().FlushThreshold
+  }
+  if conf.FlushInterval < 0 {
+    conf.FlushInterval = 0
+  }
+  loc, err := time.LoadLocation(conf.Timezone)
+  if err != nil {
+    return err
+  }
+  rules, err := aggregator.LoadBucketRules(conf.BucketRules)
+  if err != nil {
+    return err
+  }
+  // Catch bad scrub patterns now rather than when the aggregator gets them
+  if _, err := aggregator.CompilePolicy(conf.Policy); err != nil {
+    return err
+  }
+  // Stats files can only be compressed or deleted under file storage,
+  // drop those rules rather than have every rollover fail on them
+  if conf.Storage != "file" && conf.Retention.stats_files() {
+    log.Println("Compressing and deleting stats files only applies to the file storage backend, ignoring it")
+    conf.Retention.CompressAfterDays = 0
+    conf.Retention.DeleteAfterMonths = 0
+  }
+  if err := aggregator.CheckCrosstabRules(conf.Crosstabs); err != nil {
+    return err
+  }
+  CONFIG = conf
+  LOCATION = loc
+  BUCKET_RULES = rules
+  return nil
+}
+
+func shard_count() int {
+  if CONFIG.Shards > 0 { return CONFIG.Shards }
+  return runtime.NumCPU()
+}
+
+// Counting settings handed to the aggregator
+func aggregator_config() aggregator.Config {
+  return aggregator.Config{
+    BucketRules: BUCKET_RULES,
+    Policy: CONFIG.Policy,
+    Cardinality: CONFIG.Cardinality,
+    ArrayKeys: CONFIG.ArrayKeys,
+    Crosstabs: CONFIG.Crosstabs,
+    Logf: log.Printf,
+  }
+}
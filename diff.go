@@ -0,0 +1,250 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "math"
+  "os"
+  "sort"
+  "strings"
+)
+
+// Change in one number between two stats files. Percent is nil when the
+// old value was 0.
+type diff_number struct{
+  Old float64 `json:"old"`
+  New float64 `json:"new"`
+  Delta float64 `json:"delta"`
+  Percent *float64 `json:"percent"`
+}
+
+// Change in one bucket of a map, with its share of the map's total
+type diff_value struct{
+  Value string `json:"value"`
+  diff_number
+  OldShare float64 `json:"old_share"`
+  NewShare float64 `json:"new_share"`
+  ShareShift float64 `json:"share_shift"`
+  // "new", "vanished" or empty
+  Status string `json:"status,omitempty"`
+}
+
+type diff_path struct{
+  Path string `json:"path"`
+  // "new", "vanished" or empty, for the path as a whole
+  Status string `json:"status,omitempty"`
+  Values []diff_value `json:"values"`
+}
+
+type diff_report struct{
+  Old string `json:"old"`
+  New string `json:"new"`
+  Systems diff_number `json:"systems"`
+  Submissions diff_number `json:"submissions"`
+  Capacity diff_number `json:"total_capacity_gb"`
+  Disks diff_number `json:"total_disks"`
+  Country []diff_value `json:"country"`
+  Stats []diff_path `json:"stats"`
+}
+
+func diff_numbers(old float64, new float64) diff_number {
+  d := diff_number{Old: old, New: new, Delta: new - old}
+  if old != 0 {
+    pct := (new - old) / old * 100
+    d.Percent = &pct
+  }
+  return d
+}
+
+// Compare two bucket maps value by value. Unchanged values (same count and
+// share) are left out unless all is set.
+func diff_maps(old map[string]float64, new map[string]float64, all bool) []diff_value {
+  oldtotal, newtotal := 0.0, 0.0
+  values := make(map[string]bool)
+  for value, num := range(old) { oldtotal += num; values[value] = true }
+  for value, num := range(new) { newtotal += num; values[value] = true }
+  var out []diff_value
+  for value := range(values) {
+    o, inold := old[value]
+    n, innew := new[value]
+    d := diff_value{Value: value, diff_number: diff_numbers(o, n)}
+    if oldtotal > 0 { d.OldShare = o / oldtotal * 100 }
+    if newtotal > 0 { d.NewShare = n / newtotal * 100 }
+    d.ShareShift = d.NewShare - d.OldShare
+    if !inold {
+      d.Status = "new"
+    } else if !innew {
+      d.Status = "vanished"
+    } else if !all && d.Delta == 0 && d.ShareShift == 0 {
+      continue
+    }
+    out = append(out, d)
+  }
+  // Biggest movers first
+  sort.Slice(out, func(i, j int) bool {
+    si, sj := abs_float(out[i].ShareShift), abs_float(out[j].ShareShift)
+    if si != sj { return si > sj }
+    return out[i].Value < out[j].Value
+  })
+  return out
+}
+
+func abs_float(val float64) float64 {
+  if val < 0 { return -val }
+  return val
+}
+
+func diff_outputs(oldname string, old output_json, newname string, new output_json, all bool) diff_report {
+  report := diff_report{
+    Old: oldname,
+    New: newname,
+    Systems: diff_numbers(float64(old.Syscount), float64(new.Syscount)),
+    Submissions: diff_numbers(float64(old.Submissions), float64(new.Submissions)),
+    Capacity: diff_numbers(old.Capacity, new.Capacity),
+    Disks: diff_numbers(float64(old.Disks), float64(new.Disks)),
+    Country: diff_maps(old.Country, new.Country, all),
+  }
+  // Each side borrows the other's layout, so a file from before type
+  // markers existed lines up with a newer one
+  oldflat, newflat := flatten_output(old, new.Types), flatten_output(new, old.Types)
+  paths := make(map[string]bool)
+  for statpath := range(oldflat.Stats) { paths[statpath] = true }
+  for statpath := range(newflat.Stats) { paths[statpath] = true }
+  sorted := make([]string, 0, len(paths))
+  for statpath := range(paths) { sorted = append(sorted, statpath) }
+  sort.Strings(sorted)
+  for _, statpath := range(sorted) {
+    o, inold := oldflat.Stats[statpath]
+    n, innew := newflat.Stats[statpath]
+    dp := diff_path{Path: statpath, Values: diff_maps(o, n, all)}
+    if !inold {
+      dp.Status = "new"
+    } else if !innew {
+      dp.Status = "vanished"
+    }
+    if len(dp.Values) == 0 && dp.Status == "" { continue }
+    report.Stats = append(report.Stats, dp)
+  }
+  return report
+}
+
+// A diff argument is a stats file, or else a period ("2020-06-01" or
+// "2020-06") loaded from storage
+func load_diff_input(arg string, segment string) (output_json, error) {
+  if _, err := os.Stat(arg); err == nil {
+    return read_output_json(arg)
+  }
+  out, found, err := STORAGE.LoadAggregate(arg, segment)
+  if err != nil { return out, err }
+  if !found {
+    return out, fmt.Errorf("No such file or stored period: %s", arg)
+  }
+  return out, nil
+}
+
+func format_percent(pct *float64) string {
+  if pct == nil { return "-" }
+  return fmt.Sprintf("%+.1f%%", *pct)
+}
+
+// Counts as they are, fractions (capacity) to two places
+func format_rounded(val float64) string {
+  return format_count(math.Round(val*100) / 100)
+}
+
+func format_delta(val float64) string {
+  if val > 0 { return "+" + format_rounded(val) }
+  return format_rounded(val)
+}
+
+func write_diff_text(w io.Writer, report diff_report) {
+  fmt.Fprintf(w, "%s -> %s\n\n", report.Old, report.New)
+  totals := []struct{ name string; d diff_number }{
+    {"systems", report.Systems},
+    {"submissions", report.Submissions},
+    {"total_capacity_gb", report.Capacity},
+    {"total_disks", report.Disks},
+  }
+  for _, t := range(totals) {
+    fmt.Fprintf(w, "%-18s %12s -> %-12s %12s %8s\n", t.name, format_rounded(t.d.Old), format_rounded(t.d.New), format_delta(t.d.Delta), format_percent(t.d.Percent))
+  }
+  write_values := func(values []diff_value) {
+    for _, v := range(values) {
+      fmt.Fprintf(w, "  %-30s %10s -> %-10s %10s %8s  share %5.1f%% -> %5.1f%% (%+.1f) %s\n", v.Value, format_rounded(v.Old), format_rounded(v.New), format_delta(v.Delta), format_percent(v.Percent), v.OldShare, v.NewShare, v.ShareShift, v.Status)
+    }
+  }
+  if len(report.Country) > 0 {
+    fmt.Fprintf(w, "\ncountry\n")
+    write_values(report.Country)
+  }
+  for _, p := range(report.Stats) {
+    fmt.Fprintf(w, "\n%s %s\n", p.Path, p.Status)
+    write_values(p.Values)
+  }
+}
+
+func write_diff_markdown(w io.Writer, report diff_report) {
+  fmt.Fprintf(w, "# %s vs %s\n\n", report.New, report.Old)
+  fmt.Fprintf(w, "| | %s | %s | change | %% |\n|---|---:|---:|---:|---:|\n", report.Old, report.New)
+  totals := []struct{ name string; d diff_number }{
+    {"Systems", report.Systems},
+    {"Submissions", report.Submissions},
+    {"Capacity (GB)", report.Capacity},
+    {"Disks", report.Disks},
+  }
+  for _, t := range(totals) {
+    fmt.Fprintf(w, "| %s | %s | %s | %s | %s |\n", t.name, format_rounded(t.d.Old), format_rounded(t.d.New), format_delta(t.d.Delta), format_percent(t.d.Percent))
+  }
+  write_values := func(title string, values []diff_value) {
+    fmt.Fprintf(w, "\n## %s\n\n", title)
+    fmt.Fprintf(w, "| value | old | new | change | %% | old share | new share | shift | |\n|---|---:|---:|---:|---:|---:|---:|---:|---|\n")
+    for _, v := range(values) {
+      value := strings.Replace(v.Value, "|", "\\|", -1)
+      fmt.Fprintf(w, "| %s | %s | %s | %s | %s | %.1f%% | %.1f%% | %+.1f | %s |\n", value, format_rounded(v.Old), format_rounded(v.New), format_delta(v.Delta), format_percent(v.Percent), v.OldShare, v.NewShare, v.ShareShift, v.Status)
+    }
+  }
+  if len(report.Country) > 0 {
+    write_values("country", report.Country)
+  }
+  for _, p := range(report.Stats) {
+    title := "`" + p.Path + "`"
+    if p.Status != "" { title += " (" + p.Status + ")" }
+    write_values(title, p.Values)
+  }
+}
+
+// diff [-format text|json|markdown] [-segment SEG] [-all] old new
+func diff_cmd(args []string) error {
+  flags := flag.NewFlagSet("diff", flag.ExitOnError)
+  format := flags.String("format", "text", "Output format: text, json or markdown")
+  segment := flags.String("segment", "", "Segment to load when comparing stored periods (CORE, ENTERPRISE, SCALE, INTERNAL)")
+  all := flags.Bool("all", false, "Include values that didn't change")
+  flags.Parse(args)
+  if flags.NArg() != 2 {
+    return errors.New("Usage: diff [-format text|json|markdown] [-segment SEG] [-all] old.json|period new.json|period")
+  }
+  if *format != "text" && *format != "json" && *format != "markdown" {
+    return fmt.Errorf("Unknown diff format: %s", *format)
+  }
+  old, err := load_diff_input(flags.Arg(0), *segment)
+  if err != nil { return err }
+  new, err := load_diff_input(flags.Arg(1), *segment)
+  if err != nil { return err }
+  report := diff_outputs(flags.Arg(0), old, flags.Arg(1), new, *all)
+
+  switch *format {
+    case "json":
+      file, err := json.MarshalIndent(report, "", " ")
+      if err != nil { return err }
+      _, err = os.Stdout.Write(append(file, '\n'))
+      return err
+    case "markdown":
+      write_diff_markdown(os.Stdout, report)
+    default:
+      write_diff_text(os.Stdout, report)
+  }
+  return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "reflect"
+  "testing"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// The same counts as stored before type markers existed and after
+func legacy_and_new(t *testing.T) (output_json, output_json) {
+  A, _ := aggregator.New(aggregator.Config{})
+  for _, payload := range([]string{
+    `{"system_hash": "a", "platform": "FreeNAS", "hardware": {"memory": 16},
+      "pools": [{"name": "tank", "type": "raidz2"}, {"disks": 2}],
+      "network": {"nics": ["igb0", "em0"]}, "jails": [{"release": "11.2-RELEASE", "nat": true}]}`,
+    `{"system_hash": "b", "platform": "FreeNAS", "hardware": {"memory": 32},
+      "pools": [{"name": "data", "type": "mirror", "disks": 4}], "network": {"nics": ["igb0"]}}`,
+  }) {
+    decoder := json.NewDecoder(bytes.NewReader([]byte(payload)))
+    decoder.UseNumber()
+    var inputs map[string]interface{}
+    if err := decoder.Decode(&inputs); err != nil { t.Fatal(err) }
+    if err := A.Add(inputs, aggregator.Meta{Country: "US", IP: "8.8.8.8"}); err != nil { t.Fatal(err) }
+  }
+  data, err := json.Marshal(A.Daily[""])
+  if err != nil { t.Fatal(err) }
+  var new, legacy output_json
+  if err := json.Unmarshal(data, &new); err != nil { t.Fatal(err) }
+  if err := json.Unmarshal(data, &legacy); err != nil { t.Fatal(err) }
+  legacy.Types = nil
+  return legacy, new
+}
+
+func TestFlattenTyped(t *testing.T) {
+  _, new := legacy_and_new(t)
+  flat := flatten_output(new, nil)
+  if !reflect.DeepEqual(flat.Types, new.Types) {
+    t.Errorf("flat types %v\nwant       %v", flat.Types, new.Types)
+  }
+  for _, statpath := range([]string{"pools[tank].type", "pools[].disks", "network.nics[]", "jails[11.2-RELEASE].nat", "hardware.memory"}) {
+    if len(flat.Stats[statpath]) == 0 { t.Errorf("no counts for %s in %v", statpath, flat.Stats) }
+  }
+}
+
+// A file from before type markers lines up with a new one instead of
+// every keyed path showing up as vanished and new
+func TestDiffLegacy(t *testing.T) {
+  legacy, new := legacy_and_new(t)
+  report := diff_outputs("old", legacy, "new", new, false)
+  if len(report.Stats) != 0 {
+    t.Errorf("identical counts differ: %+v", report.Stats)
+  }
+  flat := flatten_output(legacy, new.Types)
+  if want := flatten_output(new, nil); !reflect.DeepEqual(flat.Stats, want.Stats) || !reflect.DeepEqual(flat.Types, want.Types) {
+    t.Errorf("legacy flattened to %v\nwant %v", flat.Types, want.Types)
+  }
+  // Without a layout to borrow, the paths are dotted and unknown
+  if flat := flatten_output(legacy, nil); flat.Types["pools.tank.type"] != "unknown" {
+    t.Errorf("got %v", flat.Types)
+  }
+}
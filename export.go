@@ -0,0 +1,233 @@
+package main
+
+import (
+  "encoding/csv"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/xitongsys/parquet-go-source/local"
+  "github.com/xitongsys/parquet-go/parquet"
+  "github.com/xitongsys/parquet-go/writer"
+)
+
+// Long-format rows written by the export command
+type export_stat_row struct{
+  Period string `parquet:"name=period, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Segment string `parquet:"name=segment, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Path string `parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Value string `parquet:"name=value, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Count float64 `parquet:"name=count, type=DOUBLE"`
+}
+
+type export_country_row struct{
+  Period string `parquet:"name=period, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Segment string `parquet:"name=segment, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Country string `parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Count float64 `parquet:"name=count, type=DOUBLE"`
+}
+
+type export_present_row struct{
+  Period string `parquet:"name=period, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Segment string `parquet:"name=segment, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Path string `parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Present float64 `parquet:"name=present, type=DOUBLE"`
+}
+
+type export_crosstab_row struct{
+  Period string `parquet:"name=period, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Segment string `parquet:"name=segment, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Crosstab string `parquet:"name=crosstab, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Row string `parquet:"name=row, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Column string `parquet:"name=column, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Count float64 `parquet:"name=count, type=DOUBLE"`
+}
+
+type export_totals_row struct{
+  Period string `parquet:"name=period, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Segment string `parquet:"name=segment, type=BYTE_ARRAY, convertedtype=UTF8"`
+  Systems int64 `parquet:"name=systems, type=INT64"`
+  Submissions int64 `parquet:"name=submissions, type=INT64"`
+  Capacity float64 `parquet:"name=total_capacity_gb, type=DOUBLE"`
+  CapacityBytes int64 `parquet:"name=total_capacity_bytes, type=INT64"`
+  Disks int64 `parquet:"name=total_disks, type=INT64"`
+}
+
+// Work out the period and segment from a stats file name, following
+// symlinks so latest-*.json exports under its real period
+func period_from_filename(path string) (string, string) {
+  if real, err := filepath.EvalSymlinks(path); err == nil {
+    path = real
+  }
+  name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".gz"), ".json")
+  for _, layout := range([]string{"2006-01-02", "2006-01"}) {
+    if len(name) < len(layout) { continue }
+    if _, err := time.Parse(layout, name[:len(layout)]); err != nil { continue }
+    return name[:len(layout)], strings.TrimPrefix(name[len(layout):], "-")
+  }
+  return name, ""
+}
+
+func read_output_json(path string) (output_json, error) {
+  var out output_json
+  dat, err := read_stats_file(path)
+  if err != nil { return out, err }
+  err = json.Unmarshal(dat, &out)
+  return out, err
+}
+
+// export [-format csv|parquet] [-o dir] file.json ...
+func export_cmd(args []string) error {
+  flags := flag.NewFlagSet("export", flag.ExitOnError)
+  format := flags.String("format", "csv", "Output format: csv or parquet")
+  outdir := flags.String("o", ".", "Directory to write stats, country, present, crosstab and totals tables to")
+  flags.Parse(args)
+  if flags.NArg() == 0 {
+    return errors.New("Usage: export [-format csv|parquet] [-o dir] file.json ...")
+  }
+  if *format != "csv" && *format != "parquet" {
+    return fmt.Errorf("Unknown export format: %s", *format)
+  }
+
+  var stats []export_stat_row
+  var countries []export_country_row
+  var present []export_present_row
+  var crosstabs []export_crosstab_row
+  var totals []export_totals_row
+  for _, path := range(flags.Args()) {
+    out, err := read_output_json(path)
+    if err != nil {
+      return fmt.Errorf("%s: %v", path, err)
+    }
+    period, segment := period_from_filename(path)
+    out.Stats.Walk(func(statpath string, value string, count uint64) {
+      stats = append(stats, export_stat_row{period, segment, statpath, value, float64(count)})
+    })
+    codes := make([]string, 0, len(out.Country))
+    for code := range(out.Country) { codes = append(codes, code) }
+    sort.Strings(codes)
+    for _, code := range(codes) {
+      countries = append(countries, export_country_row{period, segment, code, out.Country[code]})
+    }
+    paths := make([]string, 0, len(out.Present))
+    for statpath := range(out.Present) { paths = append(paths, statpath) }
+    sort.Strings(paths)
+    for _, statpath := range(paths) {
+      present = append(present, export_present_row{period, segment, statpath, out.Present[statpath]})
+    }
+    crosstabs = append(crosstabs, crosstab_rows(period, segment, out.Crosstab)...)
+    totals = append(totals, export_totals_row{period, segment, int64(out.Syscount), int64(out.Submissions), out.Capacity, int64(out.CapacityBytes), int64(out.Disks)})
+  }
+
+  if err := os.MkdirAll(*outdir, 0755); err != nil { return err }
+  if *format == "parquet" {
+    if err := write_parquet(*outdir+"/stats.parquet", new(export_stat_row), stats); err != nil { return err }
+    if err := write_parquet(*outdir+"/country.parquet", new(export_country_row), countries); err != nil { return err }
+    if err := write_parquet(*outdir+"/present.parquet", new(export_present_row), present); err != nil { return err }
+    if err := write_parquet(*outdir+"/crosstab.parquet", new(export_crosstab_row), crosstabs); err != nil { return err }
+    return write_parquet(*outdir+"/totals.parquet", new(export_totals_row), totals)
+  }
+
+  rows := [][]string{{"period", "segment", "path", "value", "count"}}
+  for _, r := range(stats) {
+    rows = append(rows, []string{r.Period, r.Segment, r.Path, r.Value, format_count(r.Count)})
+  }
+  if err := write_csv(*outdir+"/stats.csv", rows); err != nil { return err }
+
+  rows = [][]string{{"period", "segment", "country", "count"}}
+  for _, r := range(countries) {
+    rows = append(rows, []string{r.Period, r.Segment, r.Country, format_count(r.Count)})
+  }
+  if err := write_csv(*outdir+"/country.csv", rows); err != nil { return err }
+
+  rows = [][]string{{"period", "segment", "path", "present"}}
+  for _, r := range(present) {
+    rows = append(rows, []string{r.Period, r.Segment, r.Path, format_count(r.Present)})
+  }
+  if err := write_csv(*outdir+"/present.csv", rows); err != nil { return err }
+
+  rows = [][]string{{"period", "segment", "crosstab", "row", "column", "count"}}
+  for _, r := range(crosstabs) {
+    rows = append(rows, []string{r.Period, r.Segment, r.Crosstab, r.Row, r.Column, format_count(r.Count)})
+  }
+  if err := write_csv(*outdir+"/crosstab.csv", rows); err != nil { return err }
+
+  rows = [][]string{{"period", "segment", "systems", "submissions", "total_capacity_gb", "total_capacity_bytes", "total_disks"}}
+  for _, r := range(totals) {
+    rows = append(rows, []string{r.Period, r.Segment, strconv.FormatInt(r.Systems, 10), strconv.FormatInt(r.Submissions, 10), format_count(r.Capacity), strconv.FormatInt(r.CapacityBytes, 10), strconv.FormatInt(r.Disks, 10)})
+  }
+  return write_csv(*outdir+"/totals.csv", rows)
+}
+
+// Rows of every cross-tab table in a file, sorted by table, row and column
+func crosstab_rows(period string, segment string, crosstab map[string]map[string]map[string]float64) []export_crosstab_row {
+  var rows []export_crosstab_row
+  for name, table := range(crosstab) {
+    for row, cols := range(table) {
+      for col, num := range(cols) {
+        rows = append(rows, export_crosstab_row{period, segment, name, row, col, num})
+      }
+    }
+  }
+  sort.Slice(rows, func(i, j int) bool {
+    a, b := rows[i], rows[j]
+    if a.Crosstab != b.Crosstab { return a.Crosstab < b.Crosstab }
+    if a.Row != b.Row { return a.Row < b.Row }
+    return a.Column < b.Column
+  })
+  return rows
+}
+
+func format_count(val float64) string {
+  return strconv.FormatFloat(val, 'f', -1, 64)
+}
+
+func write_csv(path string, rows [][]string) error {
+  file, err := os.Create(path)
+  if err != nil { return err }
+  w := csv.NewWriter(file)
+  w.WriteAll(rows)
+  if err := w.Error(); err != nil {
+    file.Close()
+    return err
+  }
+  return file.Close()
+}
+
+// Write rows (a slice of schema's type) to a snappy compressed parquet file
+func write_parquet(path string, schema interface{}, rows interface{}) error {
+  fw, err := local.NewLocalFileWriter(path)
+  if err != nil { return err }
+  pw, err := writer.NewParquetWriter(fw, schema, 1)
+  if err != nil {
+    fw.Close()
+    return err
+  }
+  pw.CompressionType = parquet.CompressionCodec_SNAPPY
+  switch list := rows.(type) {
+    case []export_stat_row:
+      for _, r := range(list) { err = pw.Write(r); if err != nil { break } }
+    case []export_country_row:
+      for _, r := range(list) { err = pw.Write(r); if err != nil { break } }
+    case []export_present_row:
+      for _, r := range(list) { err = pw.Write(r); if err != nil { break } }
+    case []export_crosstab_row:
+      for _, r := range(list) { err = pw.Write(r); if err != nil { break } }
+    case []export_totals_row:
+      for _, r := range(list) { err = pw.Write(r); if err != nil { break } }
+  }
+  if err == nil {
+    err = pw.WriteStop()
+  }
+  if cerr := fw.Close(); err == nil {
+    err = cerr
+  }
+  return err
+}
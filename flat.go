@@ -0,0 +1,178 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "strings"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// The stats with one entry per stat path instead of nested maps:
+// {"hardware.memory": {"16GB": 120}, "pools[].type": {...}}, with the
+// kind of value each path held under "types"
+type flat_json struct{
+  Syscount uint `json:"systems"`
+  Country map[string]float64 `json:"country"`
+  Capacity float64 `json:"total_capacity_gb"`
+  CapacityBytes uint64 `json:"total_capacity_bytes"`
+  Disks uint64 `json:"total_disks"`
+  Submissions uint `json:"submissions"`
+  Stats map[string]map[string]float64 `json:"stats"`
+  Types map[string]string `json:"types"`
+  Present map[string]float64 `json:"present,omitempty"`
+  Crosstab map[string]map[string]map[string]float64 `json:"crosstab,omitempty"`
+}
+
+// Build the flat form of a stats file. The nested stats don't say which
+// levels were arrays, so every node is placed using the schema paths
+// ("pools[].type") of the file's own type markers and of ref, the types of
+// another file to borrow the layout from. That gives files from before
+// type markers existed (or counted on from one) the same bracketed paths
+// as new ones; a path neither knows is dotted and typed "unknown".
+func flatten_output(out output_json, ref map[string]string) flat_json {
+  flat := flat_json{
+    Syscount: out.Syscount,
+    Country: out.Country,
+    Capacity: out.Capacity,
+    CapacityBytes: out.CapacityBytes,
+    Disks: out.Disks,
+    Submissions: out.Submissions,
+    Stats: make(map[string]map[string]float64),
+    Types: make(map[string]string),
+    Present: out.Present,
+    Crosstab: out.Crosstab,
+  }
+  if out.Stats == nil { return flat }
+  layout := new_flat_layout(out.Types, ref)
+  layout.walk(&flat, out.Types, &out.Stats.StatsNode, "", "")
+  return flat
+}
+
+// What the type markers say about the shape of the submissions: the kind
+// counted at each schema path, and every path leading to one
+type flat_layout struct{
+  kinds map[string]string
+  prefixes map[string]bool
+}
+
+func new_flat_layout(types ...map[string]string) flat_layout {
+  layout := flat_layout{kinds: make(map[string]string), prefixes: make(map[string]bool)}
+  for _, T := range(types) {
+    for statpath, kind := range(T) {
+      schema := aggregator.SchemaPath(statpath)
+      if old, ok := layout.kinds[schema]; ok && old != kind {
+        kind = "mixed"
+      }
+      layout.kinds[schema] = kind
+      for i := 1; i < len(schema); i++ {
+        if schema[i] == '.' || schema[i] == '[' { layout.prefixes[schema[:i]] = true }
+      }
+      layout.prefixes[schema] = true
+    }
+  }
+  return layout
+}
+
+// Flatten node N, found at statpath with the given schema path
+func (L flat_layout) walk(flat *flat_json, types map[string]string, N *aggregator.StatsNode, statpath string, schema string) {
+  if len(N.Buckets) > 0 {
+    // An array of plain values counts them in the array's own node
+    if _, ok := L.kinds[schema+"[]"]; ok && statpath != "" {
+      statpath, schema = statpath+"[]", schema+"[]"
+    }
+    buckets := flat.Stats[statpath]
+    if buckets == nil {
+      buckets = make(map[string]float64, len(N.Buckets))
+      flat.Stats[statpath] = buckets
+    }
+    for value, num := range(N.Buckets) { buckets[value] += float64(num) }
+    kind, ok := types[statpath]
+    if !ok { kind, ok = L.kinds[schema] }
+    if !ok { kind = "unknown" }
+    flat.Types[statpath] = kind
+  }
+  for name, C := range(N.Children) {
+    switch {
+      case statpath == "":
+        L.walk(flat, types, C, name, name)
+      case L.prefixes[schema+"[]."+name]:
+        // A field of the array's anonymous elements
+        L.walk(flat, types, C, statpath+"[]."+name, schema+"[]."+name)
+      case L.prefixes[schema+"[]"]:
+        // The key of one of its keyed elements
+        L.walk(flat, types, C, statpath+"["+name+"]", schema+"[]")
+      default:
+        L.walk(flat, types, C, statpath+"."+name, schema+"."+name)
+    }
+  }
+}
+
+// Name of an aggregate in flat_outputs and the /stats API
+func output_name(agg storage_aggregate) string {
+  if agg.Period == MONTHLYPERIOD && agg.Segment == "" { return "MONTH" }
+  if agg.Segment == "" { return "ALL" }
+  return agg.Segment
+}
+
+// Write <period>[-SEGMENT].flat.json next to the stats for every output
+// listed in flat_outputs
+func write_flat_outputs(batch storage_batch) error {
+  for _, agg := range(batch.Aggregates) {
+    if !aggregator.MatchAny(CONFIG.FlatOutputs, output_name(agg)) { continue }
+    file, err := json.MarshalIndent(flatten_output(agg.Stats, nil), "", " ")
+    if err != nil { return err }
+    name := SDIR + "/" + agg.Period
+    if agg.Segment != "" { name += "-" + agg.Segment }
+    if err := write_file_atomic(name + ".flat.json", file); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Live counters for an output name, false if there is no such output
+func current_output(name string) (output_json, bool) {
+  snap := AGGREGATOR.Snapshot()
+  switch name = strings.ToUpper(name); name {
+    case "", "ALL": return snap.Daily[""], true
+    case "MONTH": return snap.Month, true
+  }
+  out, ok := snap.Daily[name]
+  return out, ok && name != ""
+}
+
+// GET /stats?segment=CORE&format=flat : the live counters for an output,
+// nested (as stored) or flat
+func read_stats(rw http.ResponseWriter, req *http.Request) {
+  if req.Method != "GET" {
+    http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  format := req.URL.Query().Get("format")
+  if format != "" && format != "nested" && format != "flat" {
+    http.Error(rw, "Unknown format", http.StatusBadRequest)
+    return
+  }
+  // Keep a rollover from swapping the counters out mid snapshot
+  wlock.RLock()
+  out, ok := current_output(req.URL.Query().Get("segment"))
+  var body []byte
+  var err error
+  if ok && format == "flat" {
+    body, err = json.Marshal(flatten_output(out, nil))
+  } else if ok {
+    body, err = json.Marshal(out)
+  }
+  wlock.RUnlock()
+  if !ok {
+    http.Error(rw, "Unknown segment", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    http.Error(rw, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  rw.Header().Set("Content-Type", "application/json")
+  rw.Write(body)
+}
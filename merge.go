@@ -0,0 +1,36 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "os"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// merge -o out.json file.json ...
+func merge_cmd(args []string) error {
+  flags := flag.NewFlagSet("merge", flag.ExitOnError)
+  outfile := flags.String("o", "", "File to write the merged stats to (default stdout)")
+  flags.Parse(args)
+  if flags.NArg() == 0 {
+    return errors.New("Usage: merge [-o out.json] file.json ...")
+  }
+  var merged output_json
+  for _, path := range(flags.Args()) {
+    out, err := read_output_json(path)
+    if err != nil {
+      return fmt.Errorf("%s: %v", path, err)
+    }
+    merged = aggregator.MergeOutput(merged, out)
+  }
+  file, err := json.MarshalIndent(merged, "", " ")
+  if err != nil { return err }
+  if *outfile == "" {
+    _, err = os.Stdout.Write(append(file, '\n'))
+    return err
+  }
+  return write_file_atomic(*outfile, file)
+}
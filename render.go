@@ -0,0 +1,348 @@
+package main
+
+import (
+  "bytes"
+  "errors"
+  "flag"
+  "fmt"
+  "html"
+  "html/template"
+  "log"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// Only one render runs at a time
+var renderlock sync.Mutex
+
+// Chart values of closed periods by "period/segment", so a rollover only
+// reads what closed since the last render. Guarded by renderlock.
+var RENDER_CACHE = make(map[string]render_point)
+
+// Top values shown for each stat path
+const RENDER_TOP_VALUES = 10
+
+// One point of a time series chart
+type chart_point struct{
+  Period string
+  Value float64
+}
+
+type render_row struct{
+  Label string
+  Count string
+  Share string
+}
+
+type render_path struct{
+  Path string
+  Type string
+  Rows []render_row
+}
+
+type render_chart struct{
+  Title string
+  SVG template.HTML
+}
+
+type render_segment struct{
+  Name string
+  File string
+  Period string
+  Systems uint
+  Submissions uint
+  Capacity string
+  Disks uint64
+}
+
+type render_page struct{
+  Title string
+  Generated string
+  Segments []render_segment
+  Summary render_segment
+  Charts []render_chart
+  Countries []render_row
+  Paths []render_path
+}
+
+const render_layout = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title>
+<style>
+body{font-family:sans-serif;margin:2em;color:#222}
+nav a{margin-right:1em}
+table{border-collapse:collapse;margin:0.5em 0 1.5em}
+td,th{padding:2px 10px;border-bottom:1px solid #ddd;text-align:left}
+td.n{text-align:right}
+.charts{display:flex;flex-wrap:wrap}
+.chart{margin:0 1em 1em 0}
+.path{display:inline-block;vertical-align:top;margin-right:2em}
+svg text{font-size:10px;fill:#555}
+</style></head><body>
+<nav>{{range .Segments}}<a href="{{.File}}">{{.Name}}</a>{{end}}</nav>
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated}}</p>
+{{if .Summary.Name}}
+<table>
+<tr><th>Period</th><td>{{.Summary.Period}}</td></tr>
+<tr><th>Systems</th><td class="n">{{.Summary.Systems}}</td></tr>
+<tr><th>Submissions</th><td class="n">{{.Summary.Submissions}}</td></tr>
+<tr><th>Total capacity (GB)</th><td class="n">{{.Summary.Capacity}}</td></tr>
+<tr><th>Total disks</th><td class="n">{{.Summary.Disks}}</td></tr>
+</table>
+{{else}}
+<table>
+<tr><th>Segment</th><th>Period</th><th>Systems</th><th>Submissions</th><th>Capacity (GB)</th><th>Disks</th></tr>
+{{range .Segments}}<tr><td><a href="{{.File}}">{{.Name}}</a></td><td>{{.Period}}</td><td class="n">{{.Systems}}</td><td class="n">{{.Submissions}}</td><td class="n">{{.Capacity}}</td><td class="n">{{.Disks}}</td></tr>
+{{end}}</table>
+{{end}}
+<div class="charts">{{range .Charts}}<div class="chart"><h3>{{.Title}}</h3>{{.SVG}}</div>{{end}}</div>
+{{if .Countries}}<h2>Countries</h2>
+<table><tr><th>Country</th><th>Systems</th><th>Share</th></tr>
+{{range .Countries}}<tr><td>{{.Label}}</td><td class="n">{{.Count}}</td><td class="n">{{.Share}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Paths}}<h2>Top values</h2>
+{{range .Paths}}<div class="path"><h4>{{.Path}} <small>{{.Type}}</small></h4>
+<table>{{range .Rows}}<tr><td>{{.Label}}</td><td class="n">{{.Count}}</td><td class="n">{{.Share}}</td></tr>
+{{end}}</table></div>
+{{end}}{{end}}
+</body></html>
+`
+
+var render_template = template.Must(template.New("page").Parse(render_layout))
+
+// A small line chart as inline SVG, no scripts or external assets
+func svg_line_chart(points []chart_point) template.HTML {
+  const width, height, pad = 480.0, 160.0, 30.0
+  if len(points) == 0 {
+    return template.HTML("<p>No data</p>")
+  }
+  max := 0.0
+  for _, p := range(points) {
+    if p.Value > max { max = p.Value }
+  }
+  if max == 0 { max = 1 }
+  var buf bytes.Buffer
+  fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%g" height="%g" viewBox="0 0 %g %g">`, width, height, width, height)
+  fmt.Fprintf(&buf, `<line x1="%g" y1="%g" x2="%g" y2="%g" stroke="#999"/>`, pad, height-pad, width-pad/2, height-pad)
+  var coords []string
+  for i, p := range(points) {
+    x := pad
+    if len(points) > 1 {
+      x += float64(i) * (width - pad*1.5) / float64(len(points)-1)
+    }
+    y := height - pad - p.Value/max*(height-pad*1.5)
+    coords = append(coords, fmt.Sprintf("%.1f,%.1f", x, y))
+    fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="2" fill="#2a6db0"><title>%s: %s</title></circle>`, x, y, html.EscapeString(p.Period), format_rounded(p.Value))
+  }
+  fmt.Fprintf(&buf, `<polyline fill="none" stroke="#2a6db0" stroke-width="1.5" points="%s"/>`, strings.Join(coords, " "))
+  fmt.Fprintf(&buf, `<text x="2" y="%g">%s</text>`, pad/2, format_rounded(max))
+  fmt.Fprintf(&buf, `<text x="%g" y="%g">%s</text>`, pad, height-pad/3, html.EscapeString(points[0].Period))
+  fmt.Fprintf(&buf, `<text x="%g" y="%g" text-anchor="end">%s</text>`, width-pad/2, height-pad/3, html.EscapeString(points[len(points)-1].Period))
+  buf.WriteString("</svg>")
+  return template.HTML(buf.String())
+}
+
+// Counts with their share of the total, largest first, at most limit
+// (0 for all)
+func top_rows(M map[string]float64, limit int) []render_row {
+  total := 0.0
+  labels := make([]string, 0, len(M))
+  for label, num := range(M) {
+    total += num
+    labels = append(labels, label)
+  }
+  sort.Slice(labels, func(i, j int) bool {
+    if M[labels[i]] != M[labels[j]] { return M[labels[i]] > M[labels[j]] }
+    return labels[i] < labels[j]
+  })
+  if limit > 0 && len(labels) > limit { labels = labels[:limit] }
+  var rows []render_row
+  for _, label := range(labels) {
+    share := 0.0
+    if total > 0 { share = M[label] / total * 100 }
+    rows = append(rows, render_row{label, format_count(M[label]), fmt.Sprintf("%.1f%%", share)})
+  }
+  return rows
+}
+
+// Page file name for a segment ("" is the combined stats)
+func render_file(segment string) string {
+  if segment == "" { return "all.html" }
+  return strings.ToLower(segment) + ".html"
+}
+
+func render_segment_name(segment string) string {
+  if segment == "" { return "ALL" }
+  return segment
+}
+
+// Stats and history for one segment, or the months when monthly is set
+type render_series struct{
+  segment render_segment
+  latest output_json
+  found bool
+  systems, capacity, disks []chart_point
+}
+
+// What the charts need from one stored period / segment
+type render_point struct{
+  systems uint
+  submissions uint
+  capacity float64
+  disks uint64
+  // Time of the .closed marker the values were read under
+  closed time.Time
+}
+
+// Chart values for a period / segment, only read from storage if the
+// period is open or was closed again since they were cached
+func load_render_point(period string, segment string) (render_point, bool, error) {
+  key := period + "/" + segment
+  marker, err := os.Stat(SDIR + "/" + period + ".closed")
+  closed := err == nil
+  if point, ok := RENDER_CACHE[key]; ok && closed && point.closed.Equal(marker.ModTime()) {
+    return point, true, nil
+  }
+  out, found, err := STORAGE.LoadAggregate(period, segment)
+  if err != nil { return render_point{}, false, fmt.Errorf("%s: %v", STORAGE.Location(period, segment), err) }
+  if !found { return render_point{}, false, nil }
+  point := render_point{systems: out.Syscount, submissions: out.Submissions, capacity: out.Capacity, disks: out.Disks}
+  if closed {
+    point.closed = marker.ModTime()
+    RENDER_CACHE[key] = point
+  } else {
+    delete(RENDER_CACHE, key)
+  }
+  return point, true, nil
+}
+
+func load_render_series(periods []string, segment string, monthly bool) (render_series, error) {
+  var series render_series
+  for _, period := range(periods) {
+    if (len(period) == len("2006-01")) != monthly { continue }
+    point, found, err := load_render_point(period, segment)
+    if err != nil { return series, err }
+    if !found { continue }
+    series.systems = append(series.systems, chart_point{period, float64(point.systems)})
+    series.capacity = append(series.capacity, chart_point{period, point.capacity})
+    series.disks = append(series.disks, chart_point{period, float64(point.disks)})
+    series.found = true
+    series.segment = render_segment{
+      Period: period,
+      Systems: point.systems,
+      Submissions: point.submissions,
+      Capacity: format_rounded(point.capacity),
+      Disks: point.disks,
+    }
+  }
+  // Only the newest period is shown in full
+  if series.found {
+    out, _, err := STORAGE.LoadAggregate(series.segment.Period, segment)
+    if err != nil { return series, fmt.Errorf("%s: %v", STORAGE.Location(series.segment.Period, segment), err) }
+    series.latest = out
+  }
+  return series, nil
+}
+
+func write_render_page(dir string, name string, page render_page) error {
+  var buf bytes.Buffer
+  if err := render_template.Execute(&buf, page); err != nil { return err }
+  return write_file_atomic(dir + "/" + name, buf.Bytes())
+}
+
+// Build the static site from everything in storage: an overview, a page per
+// daily segment and one for the months
+func render_site(dir string) error {
+  periods, err := STORAGE.Periods()
+  if err != nil { return err }
+  if err := os.MkdirAll(dir, 0755); err != nil { return err }
+  generated := period_now().Format("2006-01-02 15:04 MST")
+
+  var all []render_series
+  for _, segment := range(SEGMENTS) {
+    series, err := load_render_series(periods, segment, false)
+    if err != nil { return err }
+    series.segment.Name = render_segment_name(segment)
+    series.segment.File = render_file(segment)
+    all = append(all, series)
+  }
+  month, err := load_render_series(periods, "", true)
+  if err != nil { return err }
+  month.segment.Name = "MONTH"
+  month.segment.File = "month.html"
+  all = append(all, month)
+
+  var nav []render_segment
+  // Layout for flattening files from before type markers existed
+  layout := make(map[string]string)
+  for _, series := range(all) {
+    nav = append(nav, series.segment)
+    for statpath, kind := range(series.latest.Types) { layout[statpath] = kind }
+  }
+
+  for _, series := range(all) {
+    page := render_page{
+      Title: series.segment.Name,
+      Generated: generated,
+      Segments: nav,
+      Summary: series.segment,
+      Charts: []render_chart{
+        {"Systems", svg_line_chart(series.systems)},
+        {"Total capacity (GB)", svg_line_chart(series.capacity)},
+        {"Total disks", svg_line_chart(series.disks)},
+      },
+    }
+    if series.found {
+      page.Countries = top_rows(series.latest.Country, 0)
+      flat := flatten_output(series.latest, layout)
+      paths := make([]string, 0, len(flat.Stats))
+      for statpath := range(flat.Stats) { paths = append(paths, statpath) }
+      sort.Strings(paths)
+      for _, statpath := range(paths) {
+        page.Paths = append(page.Paths, render_path{statpath, flat.Types[statpath], top_rows(flat.Stats[statpath], RENDER_TOP_VALUES)})
+      }
+    }
+    if err := write_render_page(dir, series.segment.File, page); err != nil { return err }
+  }
+
+  index := render_page{
+    Title: "Usage statistics",
+    Generated: generated,
+    Segments: nav,
+    Charts: []render_chart{
+      {"Systems per day", svg_line_chart(all[0].systems)},
+      {"Systems per month", svg_line_chart(month.systems)},
+    },
+  }
+  return write_render_page(dir, "index.html", index)
+}
+
+// Rollover hook: re-render in the background once a period has closed.
+// Counted in WORKERS so shutdown doesn't cut a page off half written.
+func render_after_rollover(dir string) {
+  WORKERS.Add(1)
+  go func() {
+    defer WORKERS.Done()
+    renderlock.Lock()
+    defer renderlock.Unlock()
+    if err := render_site(dir); err != nil {
+      log.Println("Failed rendering site:", err)
+    }
+  }()
+}
+
+// render [-o dir]
+func render_cmd(args []string) error {
+  flags := flag.NewFlagSet("render", flag.ExitOnError)
+  outdir := flags.String("o", CONFIG.RenderDir, "Directory to write the HTML site to")
+  flags.Parse(args)
+  if *outdir == "" || flags.NArg() != 0 {
+    return errors.New("Usage: render -o dir")
+  }
+  renderlock.Lock()
+  defer renderlock.Unlock()
+  return render_site(*outdir)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "os"
+  "testing"
+  "time"
+)
+
+// File storage that counts the aggregates read, by "period/segment"
+type counting_storage struct{
+  *file_storage
+  loads map[string]int
+}
+
+func (c *counting_storage) LoadAggregate(period string, segment string) (output_json, bool, error) {
+  c.loads[period + "/" + segment]++
+  return c.file_storage.LoadAggregate(period, segment)
+}
+
+// Rendering again only re-reads the open period, the newest one shown in
+// full, and closed periods whose marker changed
+func TestRenderCachesClosedPeriods(t *testing.T) {
+  SDIR = t.TempDir()
+  RENDER_CACHE = make(map[string]render_point)
+  store := &counting_storage{&file_storage{dir: SDIR}, make(map[string]int)}
+  STORAGE = store
+  var batch storage_batch
+  for i, day := range([]string{"2020-06-08", "2020-06-09", "2020-06-10"}) {
+    batch.Aggregates = append(batch.Aggregates, storage_aggregate{day, "", output_json{Syscount: uint(i + 1)}})
+  }
+  if err := STORAGE.Save(batch); err != nil { t.Fatal(err) }
+  write_closed_marker("2020-06-08", []string{""})
+  write_closed_marker("2020-06-09", []string{""})
+  dir := t.TempDir()
+  if err := render_site(dir); err != nil { t.Fatal(err) }
+
+  store.loads = make(map[string]int)
+  if err := render_site(dir); err != nil { t.Fatal(err) }
+  if n := store.loads["2020-06-08/"] + store.loads["2020-06-09/"]; n != 0 {
+    t.Errorf("closed days read %d times", n)
+  }
+  if n := store.loads["2020-06-10/"]; n != 2 {
+    t.Errorf("open day read %d times", n)
+  }
+
+  // Closed again with new counters, e.g. after a rotate
+  batch = storage_batch{Aggregates: []storage_aggregate{{"2020-06-09", "", output_json{Syscount: 5}}}}
+  if err := STORAGE.Save(batch); err != nil { t.Fatal(err) }
+  later := time.Now().Add(time.Minute)
+  if err := os.Chtimes(SDIR + "/2020-06-09.closed", later, later); err != nil { t.Fatal(err) }
+  store.loads = make(map[string]int)
+  if err := render_site(dir); err != nil { t.Fatal(err) }
+  if n := store.loads["2020-06-09/"]; n != 1 {
+    t.Errorf("reclosed day read %d times", n)
+  }
+  if got := RENDER_CACHE["2020-06-09/"].systems; got != 5 {
+    t.Errorf("cached %d systems", got)
+  }
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+  "compress/gzip"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+)
+
+// What happens to period files and the raw archive once they are old.
+// Compressing and deleting stats files only applies to file storage;
+// under sqlite delete_ids purges the dedup_ids rows instead.
+type retention_config struct{
+  // Gzip daily stats files this many days after the day (0 disables)
+  CompressAfterDays int `json:"compress_after_days"`
+  // Delete the .id dedup files (raw hashes and IPs) once their month has
+  // closed, or their rows in sqlite
+  DeleteIDs bool `json:"delete_ids"`
+  // Delete daily files this many months after their month, if the
+  // monthly file exists (0 disables)
+  DeleteAfterMonths int `json:"delete_after_months"`
+  // Gzip raw archive days this many days after the day (0 disables)
+  RawCompressAfterDays int `json:"raw_compress_after_days"`
+  // Delete raw archive days this many days after the day (0 disables)
+  RawDeleteAfterDays int `json:"raw_delete_after_days"`
+}
+
+func (R retention_config) enabled() bool {
+  return R.files() || R.raw()
+}
+
+// Whether any rule for the stats and .id files is set
+func (R retention_config) files() bool {
+  return R.CompressAfterDays > 0 || R.DeleteIDs || R.DeleteAfterMonths > 0
+}
+
+// Whether any rule only file storage can follow is set
+func (R retention_config) stats_files() bool {
+  return R.CompressAfterDays > 0 || R.DeleteAfterMonths > 0
+}
+
+// Whether any rule for the raw archive is set
+func (R retention_config) raw() bool {
+  return R.RawCompressAfterDays > 0 || R.RawDeleteAfterDays > 0
+}
+
+// One change the retention policy makes to SDIR, or to the sqlite database
+type retention_action struct{
+  // "gzip", "delete" or "purge" (of a period's dedup_ids rows)
+  Action string
+  // The file, or for a purge the period
+  Path string
+  // Bytes, or for a purge the number of IDs
+  Size int64
+  Reason string
+}
+
+// Only one retention run at a time
+var retentionlock sync.Mutex
+
+// Split a file in SDIR into its period and the rest of its name, e.g.
+// "2020-06-01-CORE.json" is "2020-06-01" and "-CORE.json"
+func split_period_file(name string) (string, string) {
+  for _, layout := range([]string{"2006-01-02", "2006-01"}) {
+    if len(name) <= len(layout) { continue }
+    if _, err := time.Parse(layout, name[:len(layout)]); err != nil { continue }
+    rest := name[len(layout):]
+    if rest[0] != '-' && rest[0] != '.' { continue }
+    return name[:len(layout)], rest
+  }
+  return "", name
+}
+
+// Work out what the policy does to the files in dir (and its raw archive)
+// as of now. The current day and month are never touched.
+func plan_retention(dir string, policy retention_config, now time.Time) ([]retention_action, error) {
+  actions, err := plan_raw_retention(dir + "/raw", policy, now)
+  if err != nil || !policy.files() { return actions, err }
+  names, err := ioutil.ReadDir(dir)
+  if err != nil { return nil, err }
+  today := now.Format("2006-01-02")
+  month := now.Format("2006-01")
+  compress_before := now.AddDate(0, 0, -policy.CompressAfterDays).Format("2006-01-02")
+  y, m, _ := now.Date()
+  delete_before := time.Date(y, m - time.Month(policy.DeleteAfterMonths), 1, 0, 0, 0, 0, now.Location()).Format("2006-01")
+  files := &file_storage{dir: dir}
+  rolled_up := make(map[string]bool)
+
+  for _, info := range(names) {
+    // Skip the latest-*.json symlinks and the raw archive
+    if !info.Mode().IsRegular() || strings.HasSuffix(info.Name(), ".tmp") { continue }
+    name := info.Name()
+    path := dir + "/" + name
+    period, rest := split_period_file(name)
+    if period == "" || period >= today { continue }
+
+    // Monthly files: only the dedup set goes
+    if len(period) == 7 {
+      if policy.DeleteIDs && rest == ".json.id" && period < month {
+        actions = append(actions, retention_action{"delete", path, info.Size(), "month closed"})
+      }
+      continue
+    }
+
+    day_month := period[:7]
+    if policy.DeleteAfterMonths > 0 && day_month < delete_before {
+      if _, ok := rolled_up[day_month]; !ok {
+        _, err := os.Stat(files.Location(day_month, ""))
+        if os.IsNotExist(err) { _, err = os.Stat(files.Location(day_month, "") + ".gz") }
+        rolled_up[day_month] = err == nil
+      }
+      if rolled_up[day_month] {
+        actions = append(actions, retention_action{"delete", path, info.Size(), "rolled up into " + day_month})
+        continue
+      }
+    }
+    if strings.HasSuffix(rest, ".json.id") {
+      if policy.DeleteIDs && day_month < month {
+        actions = append(actions, retention_action{"delete", path, info.Size(), "month closed"})
+      }
+      continue
+    }
+    if strings.HasSuffix(rest, ".json") && policy.CompressAfterDays > 0 && period <= compress_before {
+      actions = append(actions, retention_action{"gzip", path, info.Size(), fmt.Sprintf("older than %d days", policy.CompressAfterDays)})
+    }
+  }
+  sort.Slice(actions, func(i, j int) bool { return actions[i].Path < actions[j].Path })
+  return actions, nil
+}
+
+// Raw archive days are gzipped, then deleted outright
+func plan_raw_retention(dir string, policy retention_config, now time.Time) ([]retention_action, error) {
+  if !policy.raw() { return nil, nil }
+  names, err := ioutil.ReadDir(dir)
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  today := now.Format("2006-01-02")
+  compress_before := now.AddDate(0, 0, -policy.RawCompressAfterDays).Format("2006-01-02")
+  delete_before := now.AddDate(0, 0, -policy.RawDeleteAfterDays).Format("2006-01-02")
+  var actions []retention_action
+  for _, info := range(names) {
+    if !info.Mode().IsRegular() { continue }
+    name := info.Name()
+    path := dir + "/" + name
+    day, rest := split_period_file(name)
+    if len(day) != 10 || day >= today { continue }
+    switch {
+      case policy.RawDeleteAfterDays > 0 && day <= delete_before && (rest == ".jsonl" || rest == ".jsonl.gz"):
+        actions = append(actions, retention_action{"delete", path, info.Size(), fmt.Sprintf("raw archive older than %d days", policy.RawDeleteAfterDays)})
+      case policy.RawCompressAfterDays > 0 && day <= compress_before && rest == ".jsonl":
+        actions = append(actions, retention_action{"gzip", path, info.Size(), fmt.Sprintf("raw archive older than %d days", policy.RawCompressAfterDays)})
+    }
+  }
+  return actions, nil
+}
+
+// Compress path to path.gz, removing the original once the copy is in place
+func gzip_file(path string) error {
+  in, err := os.Open(path)
+  if err != nil { return err }
+  defer in.Close()
+  tmp := path + ".gz.tmp"
+  out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if err != nil { return err }
+  writer := gzip.NewWriter(out)
+  writer.Name = filepath.Base(path)
+  _, err = io.Copy(writer, in)
+  if err == nil { err = writer.Close() }
+  if cerr := out.Close(); err == nil { err = cerr }
+  if err == nil { err = os.Rename(tmp, path + ".gz") }
+  if err != nil {
+    os.Remove(tmp)
+    return err
+  }
+  return os.Remove(path)
+}
+
+// Carry out the actions, stopping at the first failure
+func apply_retention(actions []retention_action) error {
+  for _, act := range(actions) {
+    var err error
+    switch act.Action {
+      case "gzip":
+        err = gzip_file(act.Path)
+      case "delete":
+        err = os.Remove(act.Path)
+      case "purge":
+        if S, ok := STORAGE.(*sqlite_storage); ok {
+          err = S.purge_ids(act.Path)
+        }
+    }
+    if err != nil && !os.IsNotExist(err) {
+      return fmt.Errorf("%s %s: %v", act.Action, act.Path, err)
+    }
+  }
+  return nil
+}
+
+func print_retention(w io.Writer, actions []retention_action, dry bool) {
+  verb := map[string]string{"gzip": "gzipped", "delete": "deleted", "purge": "purged"}
+  if dry { verb = map[string]string{"gzip": "would gzip", "delete": "would delete", "purge": "would purge"} }
+  var total, ids int64
+  files := 0
+  for _, act := range(actions) {
+    if act.Action == "purge" {
+      fmt.Fprintf(w, "%-12s %-48s %10d ids    (%s)\n", verb[act.Action], "dedup_ids " + act.Path, act.Size, act.Reason)
+      ids += act.Size
+      continue
+    }
+    fmt.Fprintf(w, "%-12s %-48s %10d bytes  (%s)\n", verb[act.Action], act.Path, act.Size, act.Reason)
+    files++
+    if act.Action == "delete" { total += act.Size }
+  }
+  fmt.Fprintf(w, "%d files, %d bytes deleted\n", files, total)
+  if ids > 0 { fmt.Fprintf(w, "%d dedup IDs purged\n", ids) }
+}
+
+func run_retention(policy retention_config, dry bool, w io.Writer) error {
+  if _, ok := STORAGE.(*file_storage); !ok && policy.stats_files() {
+    return errors.New("Compressing and deleting stats files only applies to the file storage backend")
+  }
+  retentionlock.Lock()
+  defer retentionlock.Unlock()
+  now := period_now()
+  var actions []retention_action
+  var err error
+  if S, ok := STORAGE.(*sqlite_storage); ok {
+    actions, err = plan_raw_retention(SDIR + "/raw", policy, now)
+    if err == nil && policy.DeleteIDs {
+      var purges []retention_action
+      purges, err = S.plan_id_purge(now)
+      actions = append(actions, purges...)
+    }
+  } else {
+    actions, err = plan_retention(SDIR, policy, now)
+  }
+  if err != nil { return err }
+  if !dry {
+    err = apply_retention(actions)
+  }
+  print_retention(w, actions, dry)
+  return err
+}
+
+// Apply the configured policy in the background once a day has closed,
+// counted in WORKERS so shutdown waits for it
+func retention_after_rollover(policy retention_config) {
+  WORKERS.Add(1)
+  go func() {
+    defer WORKERS.Done()
+    var report strings.Builder
+    if err := run_retention(policy, false, &report); err != nil {
+      log.Println("Retention failed:", err)
+    }
+    for _, line := range(strings.Split(strings.TrimSpace(report.String()), "\n")) {
+      log.Println("Retention:", line)
+    }
+  }()
+}
+
+// retention [-dry-run] [-compress-after days] [-delete-ids] [-delete-after months]
+// [-raw-compress-after days] [-raw-delete-after days]
+func retention_cmd(args []string) error {
+  flags := flag.NewFlagSet("retention", flag.ExitOnError)
+  dry := flags.Bool("dry-run", false, "Report what would change without touching any files")
+  compress := flags.Int("compress-after", CONFIG.Retention.CompressAfterDays, "Gzip daily files this many days old (0 disables)")
+  ids := flags.Bool("delete-ids", CONFIG.Retention.DeleteIDs, "Delete .id files of closed months")
+  months := flags.Int("delete-after", CONFIG.Retention.DeleteAfterMonths, "Delete daily files this many months old if the monthly file exists (0 disables)")
+  raw_compress := flags.Int("raw-compress-after", CONFIG.Retention.RawCompressAfterDays, "Gzip raw archive days this many days old (0 disables)")
+  raw_delete := flags.Int("raw-delete-after", CONFIG.Retention.RawDeleteAfterDays, "Delete raw archive days this many days old (0 disables)")
+  flags.Parse(args)
+  if flags.NArg() != 0 || *compress < 0 || *months < 0 || *raw_compress < 0 || *raw_delete < 0 {
+    return errors.New("Usage: retention [-dry-run] [-compress-after days] [-delete-ids] [-delete-after months] [-raw-compress-after days] [-raw-delete-after days]")
+  }
+  policy := retention_config{
+    CompressAfterDays: *compress,
+    DeleteIDs: *ids,
+    DeleteAfterMonths: *months,
+    RawCompressAfterDays: *raw_compress,
+    RawDeleteAfterDays: *raw_delete,
+  }
+  if !policy.enabled() {
+    return errors.New("Nothing to do: set retention in the config or pass -compress-after, -delete-ids, -delete-after, -raw-compress-after or -raw-delete-after")
+  }
+  return run_retention(policy, *dry, os.Stdout)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+// Under sqlite delete_ids purges the dedup rows of closed months and
+// leaves the current month's alone
+func TestRetentionPurgesSqliteIDs(t *testing.T) {
+  SDIR = t.TempDir()
+  store, err := open_sqlite_storage(SDIR + "/stats.db")
+  if err != nil { t.Fatal(err) }
+  defer store.db.Close()
+  STORAGE = store
+  now := period_now()
+  last := now.AddDate(0, -1, 0)
+  day, month := now.Format("2006-01-02"), now.Format("2006-01")
+  old_day, old_month := last.Format("2006-01-02"), last.Format("2006-01")
+  ids := map[string]bool{"hash1": true, "10.0.0.1": true}
+  err = store.Save(storage_batch{IDs: []storage_ids{
+    {Period: day, IDs: ids}, {Period: month, IDs: ids},
+    {Period: old_day, IDs: ids}, {Period: old_month, IDs: ids},
+  }})
+  if err != nil { t.Fatal(err) }
+
+  var report strings.Builder
+  if err := run_retention(retention_config{DeleteIDs: true}, true, &report); err != nil { t.Fatal(err) }
+  if !strings.Contains(report.String(), "4 dedup IDs purged") { t.Errorf("dry run report: %s", report.String()) }
+  if got, _ := store.LoadIDs(old_day); len(got) != 2 { t.Fatalf("dry run purged %s", old_day) }
+
+  report.Reset()
+  if err := run_retention(retention_config{DeleteIDs: true}, false, &report); err != nil { t.Fatal(err) }
+  for _, period := range([]string{old_day, old_month}) {
+    if got, _ := store.LoadIDs(period); got != nil { t.Errorf("%s kept %v", period, got) }
+  }
+  for _, period := range([]string{day, month}) {
+    if got, _ := store.LoadIDs(period); len(got) != 2 { t.Errorf("%s lost its IDs: %v", period, got) }
+  }
+
+  // The stats file rules still can't run here
+  if err := run_retention(retention_config{CompressAfterDays: 1}, true, &report); err == nil {
+    t.Error("compress_after_days accepted under sqlite")
+  }
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+  "encoding/json"
+  "log"
+  "os"
+  "time"
+)
+
+type closed_marker struct{
+  Period string `json:"period"`
+  ClosedAt string `json:"closed_at"`
+  Timezone string `json:"timezone"`
+  Files []string `json:"files"`
+}
+
+// Current time in the configured timezone
+func period_now() time.Time {
+  return time.Now().In(LOCATION)
+}
+
+// Start of the day after t, in t's timezone
+func next_day_boundary(t time.Time) time.Time {
+  y, m, d := t.Date()
+  return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
+// Drop a <period>.closed file next to a finished period's files so
+// consumers know it will not change again
+func write_closed_marker(period string, segments []string) {
+  marker := closed_marker{
+    Period: period,
+    ClosedAt: time.Now().In(LOCATION).Format(time.RFC3339),
+    Timezone: LOCATION.String(),
+  }
+  for _, segment := range(segments) {
+    marker.Files = append(marker.Files, STORAGE.Location(period, segment))
+  }
+  file, _ := json.MarshalIndent(marker, "", " ")
+  if err := write_file_atomic(SDIR+"/"+period+".closed", file); err != nil {
+    log.Println("Failed writing period marker:", err)
+  }
+}
+
+// Take the marker back off a period that is being counted again
+func reopen_period(period string) {
+  if err := os.Remove(SDIR+"/"+period+".closed"); err != nil && !os.IsNotExist(err) {
+    log.Println("Failed removing period marker:", err)
+  }
+}
+
+// How soon a rollover whose flush failed is tried again
+const ROLLOVER_RETRY = time.Minute
+
+// Roll the files over at each day boundary even if nothing is submitted
+func rollover_loop() {
+  defer WORKERS.Done()
+  for {
+    wlock.RLock()
+    now := period_now()
+    failed := ROLLOVER_ERR != nil
+    wlock.RUnlock()
+    wait := next_day_boundary(now).Sub(now)
+    // Wake up at least hourly so a timezone reload is picked up, and
+    // retry a rollover that couldn't flush every minute
+    if wait > time.Hour { wait = time.Hour }
+    if failed { wait = ROLLOVER_RETRY }
+    timer := time.NewTimer(wait)
+    select {
+    case <-STOP:
+      timer.Stop()
+      return
+    case <-timer.C:
+    }
+    slock.Lock()
+    wlock.Lock()
+    get_daily_filename()
+    wlock.Unlock()
+    slock.Unlock()
+  }
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+  "errors"
+  "os"
+  "testing"
+  "time"
+
+  "github.com/freenas/usage-collector/aggregator"
+)
+
+// File storage whose saves can be made to fail
+type failing_storage struct{
+  *file_storage
+  fail bool
+}
+
+func (f *failing_storage) Save(batch storage_batch) error {
+  if f.fail { return errors.New("disk full") }
+  return f.file_storage.Save(batch)
+}
+
+// Counters for day, as at startup
+func start_period(t *testing.T, day time.Time) *failing_storage {
+  SDIR = t.TempDir()
+  CONFIG = config_json{}
+  store := &failing_storage{file_storage: &file_storage{dir: SDIR}}
+  STORAGE = store
+  AGGREGATOR, _ = aggregator.NewSharded(aggregator.Config{}, 2)
+  DAILYFILE, MONTHLYFILE, ROLLOVER_ERR = "", "", nil
+  t.Cleanup(func() { ROLLOVER_ERR = nil })
+  if err := set_period(day); err != nil { t.Fatal(err) }
+  return store
+}
+
+// A rollover that can't flush keeps the old period and its counters, and
+// closes it once a retry can
+func TestRolloverFlushFails(t *testing.T) {
+  day := time.Date(2020, 6, 10, 23, 0, 0, 0, time.UTC)
+  store := start_period(t, day)
+  submission := map[string]interface{}{"system_hash": "a", "platform": "FreeNAS"}
+  if err := AGGREGATOR.Add(submission, aggregator.Meta{IP: "8.8.8.8"}); err != nil { t.Fatal(err) }
+
+  store.fail = true
+  if err := set_period(day.Add(2 * time.Hour)); err == nil { t.Fatal("rollover succeeded without a flush") }
+  if DAILYPERIOD != "2020-06-10" || ROLLOVER_ERR == nil {
+    t.Errorf("moved on to %s, error %v", DAILYPERIOD, ROLLOVER_ERR)
+  }
+  if got := AGGREGATOR.Snapshot().Daily[""].Syscount; got != 1 {
+    t.Errorf("%d systems left in the counters", got)
+  }
+  if _, err := os.Stat(SDIR + "/2020-06-10.closed"); !os.IsNotExist(err) {
+    t.Error("unflushed day marked closed")
+  }
+
+  store.fail = false
+  if err := set_period(day.Add(2 * time.Hour)); err != nil { t.Fatal(err) }
+  if DAILYPERIOD != "2020-06-11" || ROLLOVER_ERR != nil {
+    t.Errorf("period %s, error %v", DAILYPERIOD, ROLLOVER_ERR)
+  }
+  if _, err := os.Stat(SDIR + "/2020-06-10.closed"); err != nil { t.Error(err) }
+  out, found, err := STORAGE.LoadAggregate("2020-06-10", "")
+  if err != nil || !found || out.Syscount != 1 {
+    t.Errorf("stored day: %d systems, found %v, %v", out.Syscount, found, err)
+  }
+  if got := AGGREGATOR.Snapshot().Daily[""].Syscount; got != 0 {
+    t.Errorf("new day starts with %d systems", got)
+  }
+}
+
+// Going back a day (a timezone reload) doesn't swap the counters out
+// either when they can't be flushed first
+func TestRolloverBackFlushFails(t *testing.T) {
+  day := time.Date(2020, 6, 10, 1, 0, 0, 0, time.UTC)
+  store := start_period(t, day)
+  submission := map[string]interface{}{"system_hash": "a", "platform": "FreeNAS"}
+  if err := AGGREGATOR.Add(submission, aggregator.Meta{IP: "8.8.8.8"}); err != nil { t.Fatal(err) }
+
+  store.fail = true
+  if err := set_period(day.Add(-2 * time.Hour)); err == nil { t.Fatal("moved back without a flush") }
+  if DAILYPERIOD != "2020-06-10" || MONTHLYPERIOD != "2020-06" {
+    t.Errorf("moved to %s / %s", DAILYPERIOD, MONTHLYPERIOD)
+  }
+  snap := AGGREGATOR.Snapshot()
+  if snap.Daily[""].Syscount != 1 || snap.Month.Syscount != 1 {
+    t.Errorf("counters lost: %d daily, %d monthly", snap.Daily[""].Syscount, snap.Month.Syscount)
+  }
+
+  store.fail = false
+  if err := set_period(day.Add(-2 * time.Hour)); err != nil { t.Fatal(err) }
+  if DAILYPERIOD != "2020-06-09" || MONTHLYPERIOD != "2020-06" {
+    t.Errorf("moved to %s / %s", DAILYPERIOD, MONTHLYPERIOD)
+  }
+  if _, err := os.Stat(SDIR + "/2020-06-10.closed"); !os.IsNotExist(err) {
+    t.Error("later day closed going back")
+  }
+  if out, found, _ := STORAGE.LoadAggregate("2020-06-10", ""); !found || out.Syscount != 1 {
+    t.Errorf("later day not stored before going back")
+  }
+}
+
+// A rotate mid-day closes the day so far and counts on from what it flushed
+func TestRotateMidDay(t *testing.T) {
+  day := time.Date(2020, 6, 10, 12, 0, 0, 0, time.UTC)
+  start_period(t, day)
+  submission := map[string]interface{}{"system_hash": "a", "platform": "FreeNAS"}
+  if err := AGGREGATOR.Add(submission, aggregator.Meta{IP: "8.8.8.8"}); err != nil { t.Fatal(err) }
+
+  if err := switch_period(day.Add(time.Hour), true); err != nil { t.Fatal(err) }
+  if DAILYPERIOD != "2020-06-10" || MONTHLYPERIOD != "2020-06" {
+    t.Errorf("moved to %s / %s", DAILYPERIOD, MONTHLYPERIOD)
+  }
+  if _, err := os.Stat(SDIR + "/2020-06-10.closed"); err != nil { t.Error(err) }
+  if _, err := os.Stat(SDIR + "/2020-06.closed"); !os.IsNotExist(err) {
+    t.Error("open month marked closed")
+  }
+  if out, found, _ := STORAGE.LoadAggregate("2020-06-10", ""); !found || out.Syscount != 1 {
+    t.Errorf("day not flushed before closing")
+  }
+  // Later submissions add to the day, they don't start it over
+  if err := AGGREGATOR.Add(submission, aggregator.Meta{IP: "8.8.8.8"}); err != nil { t.Fatal(err) }
+  if got := AGGREGATOR.Snapshot().Daily[""].Syscount; got != 2 {
+    t.Errorf("%d systems after the rotate", got)
+  }
+}
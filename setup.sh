@@ -1,5 +1,8 @@
 #!/bin/sh
 #Setup this utility for building
 go get github.com/oschwald/geoip2-golang
+go get github.com/mattn/go-sqlite3
+go get github.com/xitongsys/parquet-go
+go get github.com/xitongsys/parquet-go-source
 #Build it
-go build usage.go
+go build -o usage .
@@ -0,0 +1,376 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// A /24 per country that the GeoLite2 country database places there, the
+// last octet is picked at random. "internal" addresses land in INTERNAL.
+var SIM_NETWORKS = map[string]string{
+  "US": "8.8.8", "CA": "24.48.10", "BR": "200.147.10",
+  "GB": "81.2.69", "DE": "5.9.10", "NL": "145.97.10", "FR": "62.210.10",
+  "SE": "80.67.10", "RU": "77.88.55", "ZA": "41.203.10",
+  "IN": "49.44.10", "CN": "114.114.114", "JP": "133.242.10",
+  "SG": "210.10.10", "AU": "1.128.10",
+  "internal": "10.0.0",
+}
+
+// Versions reported by each simulated platform
+var SIM_VERSIONS = map[string][]string{
+  "TrueNAS-CORE": {"TrueNAS-13.0-U6.1", "TrueNAS-13.0-U5.3", "TrueNAS-12.0-U8.1"},
+  "TrueNAS-SCALE": {"TrueNAS-SCALE-24.04.2", "TrueNAS-SCALE-23.10.2", "TrueNAS-SCALE-22.12.4.2"},
+  "TrueNAS-ENTERPRISE": {"TrueNAS-13.0-U6.1", "TrueNAS-SCALE-24.04.2"},
+  "FreeNAS": {"FreeNAS-11.3-U5", "FreeNAS-11.2-U8"},
+}
+
+var SIM_POOL_TYPES = []string{"stripe", "mirror", "raidz1", "raidz2", "raidz3"}
+var SIM_RELEASES = []string{"13.2-RELEASE-p4", "13.1-RELEASE-p9", "12.4-RELEASE-p9", "12.2-RELEASE-p15"}
+var SIM_PLUGINS = []string{"plexmediaserver", "syncthing", "nextcloud", "transmission", "minio", "jellyfin", "rslsync", "homeassistant"}
+
+// Weighted choice, e.g. "US=40,DE=15"
+type sim_mix struct{
+  names []string
+  weights []float64
+  total float64
+}
+
+func parse_mix(spec string) (sim_mix, error) {
+  var mix sim_mix
+  for _, part := range(strings.Split(spec, ",")) {
+    part = strings.TrimSpace(part)
+    if part == "" { continue }
+    eq := strings.LastIndex(part, "=")
+    if eq < 1 { return mix, fmt.Errorf("Bad mix entry %q, expected name=weight", part) }
+    weight, err := strconv.ParseFloat(part[eq+1:], 64)
+    if err != nil || weight < 0 { return mix, fmt.Errorf("Bad weight in mix entry %q", part) }
+    mix.names = append(mix.names, part[:eq])
+    mix.weights = append(mix.weights, weight)
+    mix.total += weight
+  }
+  if mix.total <= 0 { return mix, fmt.Errorf("Mix %q has no weight", spec) }
+  return mix, nil
+}
+
+func (M sim_mix) pick(R *sim_rand) string {
+  x := R.Float64() * M.total
+  for i, weight := range(M.weights) {
+    if x < weight { return M.names[i] }
+    x -= weight
+  }
+  return M.names[len(M.names)-1]
+}
+
+// Inclusive range of counts, e.g. "0-8" or "3"
+type sim_range struct{
+  min, max int
+}
+
+func parse_range(spec string) (sim_range, error) {
+  lo, hi := spec, spec
+  if dash := strings.Index(spec, "-"); dash >= 0 {
+    lo, hi = spec[:dash], spec[dash+1:]
+  }
+  min, err1 := strconv.Atoi(lo)
+  max, err2 := strconv.Atoi(hi)
+  if err1 != nil || err2 != nil || min < 0 || max < min {
+    return sim_range{}, fmt.Errorf("Bad range %q, expected min-max", spec)
+  }
+  return sim_range{min, max}, nil
+}
+
+func (S sim_range) pick(R *sim_rand) int {
+  return S.min + R.Intn(S.max - S.min + 1)
+}
+
+// splitmix64: cheap to seed per system, so every system can be rebuilt
+// from its index when it reports again
+type sim_rand struct{
+  state uint64
+}
+
+func (R *sim_rand) Uint64() uint64 {
+  R.state += 0x9e3779b97f4a7c15
+  x := R.state
+  x ^= x >> 30; x *= 0xbf58476d1ce4e5b9
+  x ^= x >> 27; x *= 0x94d049bb133111eb
+  return x ^ (x >> 31)
+}
+
+func (R *sim_rand) Intn(n int) int {
+  return int(R.Uint64() % uint64(n))
+}
+
+func (R *sim_rand) Float64() float64 {
+  return float64(R.Uint64() >> 11) / (1 << 53)
+}
+
+func (R *sim_rand) Bool() bool {
+  return R.Uint64() & 1 == 1
+}
+
+type sim_fleet struct{
+  template map[string]interface{}
+  seed int64
+  platforms sim_mix
+  countries sim_mix
+  pools, jails, plugins sim_range
+}
+
+// The submission and address of simulated system i, always the same for
+// the same seed
+func (F *sim_fleet) system(i int) (map[string]interface{}, string) {
+  R := &sim_rand{uint64(F.seed) * 0x100000001b3 + uint64(i)}
+  s := make(map[string]interface{}, len(F.template))
+  for key, val := range(F.template) { s[key] = val }
+  s["system_hash"] = fmt.Sprintf("sim-%d-%d", F.seed, i)
+
+  platform := F.platforms.pick(R)
+  s["platform"] = platform
+  if versions := SIM_VERSIONS[platform]; len(versions) > 0 {
+    s["version"] = versions[R.Intn(len(versions))]
+  }
+
+  hardware := make(map[string]interface{})
+  if tmpl, ok := F.template["hardware"].(map[string]interface{}); ok {
+    for key, val := range(tmpl) { hardware[key] = val }
+  }
+  hardware["cpus"] = 2 << uint(R.Intn(5))
+  hardware["memory"] = int64(8 << uint(R.Intn(6))) << 30
+  s["hardware"] = hardware
+
+  var pools []interface{}
+  for n := F.pools.pick(R); len(pools) < n; {
+    disks := 1 + R.Intn(24)
+    capacity := int64(disks) * (int64(1 + R.Intn(16)) << 40)
+    pools = append(pools, map[string]interface{}{
+      "capacity": capacity,
+      "disks": disks,
+      "encryption": R.Intn(4) == 0,
+      "l2arc": R.Intn(5) == 0,
+      "type": SIM_POOL_TYPES[R.Intn(len(SIM_POOL_TYPES))],
+      "usedbydataset": capacity / int64(2 + R.Intn(8)),
+      "vdevs": 1 + R.Intn(4),
+      "zil": R.Intn(6) == 0,
+    })
+  }
+  s["pools"] = pools
+
+  var jails []interface{}
+  for n := F.jails.pick(R); len(jails) < n; {
+    jails = append(jails, map[string]interface{}{
+      "nat": R.Bool(),
+      "release": SIM_RELEASES[R.Intn(len(SIM_RELEASES))],
+      "vnet": R.Bool(),
+    })
+  }
+  s["jails"] = jails
+
+  var plugins []interface{}
+  n := F.plugins.pick(R)
+  if n > len(SIM_PLUGINS) { n = len(SIM_PLUGINS) }
+  for _, idx := range(sim_perm(R, len(SIM_PLUGINS))[:n]) {
+    plugins = append(plugins, map[string]interface{}{
+      "name": SIM_PLUGINS[idx],
+      "version": fmt.Sprintf("%d.%d.%d", 1 + R.Intn(3), R.Intn(10), R.Intn(20)),
+    })
+  }
+  s["plugins"] = plugins
+
+  prefix := SIM_NETWORKS[F.countries.pick(R)]
+  return s, fmt.Sprintf("%s.%d", prefix, 1 + R.Intn(254))
+}
+
+func sim_perm(R *sim_rand, n int) []int {
+  perm := make([]int, n)
+  for i := range(perm) { perm[i] = i }
+  for i := n - 1; i > 0; i-- {
+    j := R.Intn(i + 1)
+    perm[i], perm[j] = perm[j], perm[i]
+  }
+  return perm
+}
+
+// Number of systems the daily ALL stats count, from the /stats API
+func fetch_syscount(client *http.Client, statsurl string) (uint, error) {
+  resp, err := client.Get(statsurl)
+  if err != nil { return 0, err }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return 0, fmt.Errorf("%s: %s", statsurl, resp.Status)
+  }
+  var out struct{
+    Syscount uint `json:"systems"`
+  }
+  err = json.NewDecoder(resp.Body).Decode(&out)
+  return out.Syscount, err
+}
+
+// Send one submission, returning how long the collector took to accept
+// it. Anything that keeps it from being accepted is an error, including
+// failing to build the request.
+func send_submission(client *http.Client, target string, s map[string]interface{}, ip string) (time.Duration, error) {
+  body, err := json.Marshal(s)
+  if err != nil { return -1, err }
+  req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+  if err != nil { return -1, err }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("X-Forwarded-For", ip)
+  start := time.Now()
+  resp, err := client.Do(req)
+  if err != nil { return -1, err }
+  io.Copy(ioutil.Discard, resp.Body)
+  resp.Body.Close()
+  if resp.StatusCode >= 300 { return -1, errors.New(resp.Status) }
+  return time.Since(start), nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+  if len(sorted) == 0 { return 0 }
+  idx := int(p / 100 * float64(len(sorted)-1) + 0.5)
+  return sorted[idx]
+}
+
+// simulate [-url U] [-n count] [-rate N] [-workers N] [-dup rate] ... [template.json]
+func simulate_cmd(args []string) error {
+  flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+  target := flags.String("url", "http://127.0.0.1:8082/submit", "Submit endpoint to send to")
+  n := flags.Int("n", 10000, "Submissions to send")
+  rate := flags.Float64("rate", 100, "Submissions per second, 0 for as fast as possible")
+  workers := flags.Int("workers", 16, "Requests in flight at once")
+  dup := flags.Float64("dup", 0.05, "Fraction of submissions that resend a system already sent")
+  platforms := flags.String("platforms", "TrueNAS-CORE=55,TrueNAS-SCALE=35,TrueNAS-ENTERPRISE=10", "Platform mix, name=weight,...")
+  countries := flags.String("countries", "US=35,DE=12,GB=8,NL=5,FR=5,CA=5,AU=4,JP=4,BR=4,IN=4,RU=3,CN=3,SE=3,ZA=2,SG=2,internal=1", "Country mix, code=weight,... (\"internal\" for private addresses)")
+  pools := flags.String("pools", "1-4", "Pools per system, min-max")
+  jails := flags.String("jails", "0-8", "Jails per system, min-max")
+  plugins := flags.String("plugins", "0-4", "Plugins per system, min-max")
+  seed := flags.Int64("seed", time.Now().Unix(), "Seed for the generated fleet")
+  flags.Parse(args)
+  if flags.NArg() > 1 || *n < 1 || *workers < 1 || *rate < 0 || *dup < 0 || *dup >= 1 {
+    return errors.New("Usage: simulate [-url U] [-n count] [-rate N] [-workers N] [-dup rate] [-platforms mix] [-countries mix] [-pools min-max] [-jails min-max] [-plugins min-max] [-seed N] [template.json]")
+  }
+  template := "submit.json"
+  if flags.NArg() == 1 { template = flags.Arg(0) }
+
+  fleet := &sim_fleet{seed: *seed}
+  payloads, err := read_bench_payloads([]string{template})
+  if err != nil { return err }
+  fleet.template = payloads[0]
+  if fleet.platforms, err = parse_mix(*platforms); err != nil { return err }
+  if fleet.countries, err = parse_mix(*countries); err != nil { return err }
+  for _, code := range(fleet.countries.names) {
+    if _, ok := SIM_NETWORKS[code]; !ok {
+      return fmt.Errorf("No simulated addresses for country %q", code)
+    }
+  }
+  if fleet.pools, err = parse_range(*pools); err != nil { return err }
+  if fleet.jails, err = parse_range(*jails); err != nil { return err }
+  if fleet.plugins, err = parse_range(*plugins); err != nil { return err }
+
+  statsurl, err := url.Parse(*target)
+  if err != nil { return err }
+  statsurl.Path = "/stats"
+  statsurl.RawQuery = "segment=ALL"
+  client := &http.Client{
+    Timeout: 30 * time.Second,
+    Transport: &http.Transport{MaxIdleConnsPerHost: *workers},
+  }
+  before, staterr := fetch_syscount(client, statsurl.String())
+
+  // Which system each submission comes from: a new one, or with
+  // probability dup one that was already sent
+  R := &sim_rand{uint64(*seed)}
+  systems := make([]int, *n)
+  unique := 0
+  for i := range(systems) {
+    if unique > 0 && R.Float64() < *dup {
+      systems[i] = R.Intn(unique)
+    } else {
+      systems[i] = unique
+      unique++
+    }
+  }
+
+  jobs := make(chan int, *workers)
+  latencies := make([]time.Duration, *n)
+  var lock sync.Mutex
+  failed := 0
+  errs := make(map[string]int)
+  var wg sync.WaitGroup
+  for w := 0; w < *workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for i := range(jobs) {
+        s, ip := fleet.system(systems[i])
+        latency, err := send_submission(client, *target, s, ip)
+        latencies[i] = latency
+        if err != nil {
+          lock.Lock()
+          failed++
+          errs[err.Error()]++
+          lock.Unlock()
+        }
+      }
+    }()
+  }
+
+  start := time.Now()
+  for i := 0; i < *n; i++ {
+    if *rate > 0 {
+      due := start.Add(time.Duration(float64(i) / *rate * float64(time.Second)))
+      if wait := time.Until(due); wait > 0 { time.Sleep(wait) }
+    }
+    jobs <- i
+  }
+  close(jobs)
+  wg.Wait()
+  elapsed := time.Since(start)
+
+  var ok []time.Duration
+  for _, d := range(latencies) {
+    if d >= 0 { ok = append(ok, d) }
+  }
+  sort.Slice(ok, func(i, j int) bool { return ok[i] < ok[j] })
+  fmt.Printf("%d submissions from %d systems (%d resent) in %s, %.0f submissions/s\n",
+    *n, unique, *n - unique, elapsed.Round(time.Millisecond), float64(*n) / elapsed.Seconds())
+  fmt.Printf("latency p50 %s  p90 %s  p99 %s  max %s\n",
+    percentile(ok, 50).Round(time.Microsecond), percentile(ok, 90).Round(time.Microsecond),
+    percentile(ok, 99).Round(time.Microsecond), percentile(ok, 100).Round(time.Microsecond))
+  fmt.Printf("errors %d (%.2f%%)\n", failed, 100 * float64(failed) / float64(*n))
+  messages := make([]string, 0, len(errs))
+  for msg := range(errs) { messages = append(messages, msg) }
+  sort.Strings(messages)
+  for _, msg := range(messages) { fmt.Printf("  %6d %s\n", errs[msg], msg) }
+
+  if staterr != nil {
+    fmt.Fprintln(os.Stderr, "Skipping the systems check:", staterr)
+    return nil
+  }
+  after, err := fetch_syscount(client, statsurl.String())
+  if err != nil { return err }
+  if after < before {
+    return fmt.Errorf("Systems went from %d to %d, the day rolled over during the run", before, after)
+  }
+  // Every accepted submission counts as a system in the daily stats,
+  // resends included
+  expected := uint(len(ok))
+  fmt.Printf("systems %d -> %d (+%d), expected +%d\n", before, after, after - before, expected)
+  if after - before != expected {
+    return fmt.Errorf("Collector counted %d systems, expected %d", after - before, expected)
+  }
+  return nil
+}
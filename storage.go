@@ -0,0 +1,351 @@
+package main
+
+import (
+  "compress/gzip"
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/freenas/usage-collector/aggregator"
+  _ "github.com/mattn/go-sqlite3"
+)
+
+// Segments stored for every daily period ("" is the combined stats)
+var SEGMENTS = aggregator.Segments
+
+// One aggregate to persist: period is "2006-01-02" or "2006-01"
+type storage_aggregate struct{
+  Period string
+  Segment string
+  Stats output_json
+}
+
+// One dedup set to persist
+type storage_ids struct{
+  Period string
+  IDs map[string]bool
+}
+
+// Everything written by a single flush
+type storage_batch struct{
+  Aggregates []storage_aggregate
+  IDs []storage_ids
+}
+
+// Where aggregates and dedup sets live between restarts
+type storage_backend interface {
+  // Load the stats for a period / segment, found is false if none are stored yet
+  LoadAggregate(period string, segment string) (output_json, bool, error)
+  // Load the dedup set for a period, nil if none is stored yet
+  LoadIDs(period string) (map[string]bool, error)
+  // Write a whole flush, as atomically as the backend allows
+  Save(batch storage_batch) error
+  // Human readable location of a period / segment, for logs and markers
+  Location(period string, segment string) string
+  // Every period with stored aggregates, sorted
+  Periods() ([]string, error)
+  Close() error
+}
+
+// Backend currently in use
+var STORAGE storage_backend
+
+// Pick the backend from the config
+func open_storage() (storage_backend, error) {
+  switch CONFIG.Storage {
+    case "", "file":
+      return &file_storage{dir: SDIR}, nil
+    case "sqlite":
+      path := CONFIG.SQLiteFile
+      if path == "" { path = SDIR + "/stats.db" }
+      return open_sqlite_storage(path)
+  }
+  return nil, fmt.Errorf("Unknown storage backend: %s", CONFIG.Storage)
+}
+
+// The original layout: one JSON file per period / segment plus a .id file
+type file_storage struct{
+  dir string
+}
+
+func (f *file_storage) Location(period string, segment string) string {
+  if segment == "" {
+    return f.dir + "/" + period + ".json"
+  }
+  return f.dir + "/" + period + "-" + segment + ".json"
+}
+
+// Read a stats file, gunzipping it if it is (or has been compressed to)
+// a .gz file
+func read_stats_file(path string) ([]byte, error) {
+  if !strings.HasSuffix(path, ".gz") {
+    dat, err := ioutil.ReadFile(path)
+    if !os.IsNotExist(err) { return dat, err }
+    if _, gzerr := os.Stat(path + ".gz"); gzerr != nil { return dat, err }
+    path += ".gz"
+  }
+  file, err := os.Open(path)
+  if err != nil { return nil, err }
+  defer file.Close()
+  reader, err := gzip.NewReader(file)
+  if err != nil { return nil, err }
+  defer reader.Close()
+  return ioutil.ReadAll(reader)
+}
+
+func (f *file_storage) LoadAggregate(period string, segment string) (output_json, bool, error) {
+  var out output_json
+  dat, err := read_stats_file(f.Location(period, segment))
+  if os.IsNotExist(err) {
+    return out, false, nil
+  } else if err != nil {
+    return out, false, err
+  }
+  if err := json.Unmarshal(dat, &out); err != nil {
+    return out, false, err
+  }
+  if out.Country == nil {
+    out.Country = make(map[string]float64)
+  }
+  return out, true, nil
+}
+
+func (f *file_storage) LoadIDs(period string) (map[string]bool, error) {
+  dat, err := ioutil.ReadFile(f.Location(period, "") + ".id")
+  if os.IsNotExist(err) {
+    return nil, nil
+  } else if err != nil {
+    return nil, err
+  }
+  ids := make(map[string]bool)
+  err = json.Unmarshal(dat, &ids)
+  return ids, err
+}
+
+// "2006-01-02" or "2006-01"
+func is_period(name string) bool {
+  if _, err := time.Parse("2006-01-02", name); err == nil { return true }
+  _, err := time.Parse("2006-01", name)
+  return err == nil
+}
+
+func (f *file_storage) Periods() ([]string, error) {
+  names, err := ioutil.ReadDir(f.dir)
+  if err != nil { return nil, err }
+  seen := make(map[string]bool)
+  var periods []string
+  for _, info := range(names) {
+    // Compressed by the retention policy or not
+    name := strings.TrimSuffix(info.Name(), ".gz")
+    // Skip the latest-*.json symlinks and the flat copies
+    if !strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".flat.json") || !info.Mode().IsRegular() {
+      continue
+    }
+    period, _ := period_from_filename(f.dir + "/" + name)
+    if !is_period(period) { continue }
+    if !seen[period] {
+      seen[period] = true
+      periods = append(periods, period)
+    }
+  }
+  sort.Strings(periods)
+  return periods, nil
+}
+
+func (f *file_storage) Save(batch storage_batch) error {
+  // Marshal everything first so a bad aggregate doesn't leave half a flush
+  paths := []string{}
+  files := [][]byte{}
+  for _, agg := range(batch.Aggregates) {
+    file, err := json.MarshalIndent(agg.Stats, "", " ")
+    if err != nil { return err }
+    paths = append(paths, f.Location(agg.Period, agg.Segment))
+    files = append(files, file)
+  }
+  for _, set := range(batch.IDs) {
+    file, err := json.MarshalIndent(set.IDs, "", " ")
+    if err != nil { return err }
+    paths = append(paths, f.Location(set.Period, "") + ".id")
+    files = append(files, file)
+  }
+  var ferr error
+  for i, path := range(paths) {
+    if err := write_file_atomic(path, files[i]); err != nil {
+      ferr = err
+    }
+  }
+  return ferr
+}
+
+func (f *file_storage) Close() error {
+  return nil
+}
+
+// Embedded SQLite database, every flush is a single transaction
+type sqlite_storage struct{
+  path string
+  db *sql.DB
+}
+
+const sqlite_schema = `
+CREATE TABLE IF NOT EXISTS aggregates (
+  period TEXT NOT NULL,
+  segment TEXT NOT NULL,
+  systems INTEGER NOT NULL,
+  total_capacity_gb REAL NOT NULL,
+  total_disks INTEGER NOT NULL,
+  data TEXT NOT NULL,
+  updated_at TEXT NOT NULL,
+  PRIMARY KEY (period, segment)
+);
+CREATE TABLE IF NOT EXISTS dedup_ids (
+  period TEXT NOT NULL,
+  id TEXT NOT NULL,
+  PRIMARY KEY (period, id)
+);
+`
+
+func open_sqlite_storage(path string) (*sqlite_storage, error) {
+  db, err := sql.Open("sqlite3", path + "?_journal_mode=WAL&_busy_timeout=5000")
+  if err != nil { return nil, err }
+  if _, err := db.Exec(sqlite_schema); err != nil {
+    db.Close()
+    return nil, err
+  }
+  return &sqlite_storage{path: path, db: db}, nil
+}
+
+func (s *sqlite_storage) Location(period string, segment string) string {
+  return "sqlite://" + s.path + "#" + period + "/" + segment
+}
+
+func (s *sqlite_storage) LoadAggregate(period string, segment string) (output_json, bool, error) {
+  var out output_json
+  var data string
+  err := s.db.QueryRow("SELECT data FROM aggregates WHERE period = ? AND segment = ?", period, segment).Scan(&data)
+  if err == sql.ErrNoRows {
+    return out, false, nil
+  } else if err != nil {
+    return out, false, err
+  }
+  if err := json.Unmarshal([]byte(data), &out); err != nil {
+    return out, false, err
+  }
+  if out.Country == nil {
+    out.Country = make(map[string]float64)
+  }
+  return out, true, nil
+}
+
+func (s *sqlite_storage) LoadIDs(period string) (map[string]bool, error) {
+  rows, err := s.db.Query("SELECT id FROM dedup_ids WHERE period = ?", period)
+  if err != nil { return nil, err }
+  defer rows.Close()
+  var ids map[string]bool
+  for rows.Next() {
+    var id string
+    if err := rows.Scan(&id); err != nil { return nil, err }
+    if ids == nil { ids = make(map[string]bool) }
+    ids[id] = true
+  }
+  return ids, rows.Err()
+}
+
+// A purge of the dedup_ids rows of every period in a closed month, the
+// same ones whose .id files the file backend deletes
+func (s *sqlite_storage) plan_id_purge(now time.Time) ([]retention_action, error) {
+  rows, err := s.db.Query("SELECT period, COUNT(*) FROM dedup_ids WHERE period < ? GROUP BY period ORDER BY period", now.Format("2006-01"))
+  if err != nil { return nil, err }
+  defer rows.Close()
+  var actions []retention_action
+  for rows.Next() {
+    var period string
+    var n int64
+    if err := rows.Scan(&period, &n); err != nil { return nil, err }
+    actions = append(actions, retention_action{"purge", period, n, "month closed"})
+  }
+  return actions, rows.Err()
+}
+
+func (s *sqlite_storage) purge_ids(period string) error {
+  _, err := s.db.Exec("DELETE FROM dedup_ids WHERE period = ?", period)
+  return err
+}
+
+func (s *sqlite_storage) Periods() ([]string, error) {
+  rows, err := s.db.Query("SELECT DISTINCT period FROM aggregates ORDER BY period")
+  if err != nil { return nil, err }
+  defer rows.Close()
+  var periods []string
+  for rows.Next() {
+    var period string
+    if err := rows.Scan(&period); err != nil { return nil, err }
+    periods = append(periods, period)
+  }
+  return periods, rows.Err()
+}
+
+func (s *sqlite_storage) Save(batch storage_batch) error {
+  tx, err := s.db.Begin()
+  if err != nil { return err }
+  now := time.Now().UTC().Format(time.RFC3339)
+  for _, agg := range(batch.Aggregates) {
+    data, err := json.Marshal(agg.Stats)
+    if err != nil { tx.Rollback(); return err }
+    _, err = tx.Exec(`INSERT INTO aggregates (period, segment, systems, total_capacity_gb, total_disks, data, updated_at)
+      VALUES (?, ?, ?, ?, ?, ?, ?)
+      ON CONFLICT (period, segment) DO UPDATE SET systems = excluded.systems,
+        total_capacity_gb = excluded.total_capacity_gb, total_disks = excluded.total_disks,
+        data = excluded.data, updated_at = excluded.updated_at`,
+      agg.Period, agg.Segment, agg.Stats.Syscount, agg.Stats.Capacity, agg.Stats.Disks, string(data), now)
+    if err != nil { tx.Rollback(); return err }
+  }
+  for _, set := range(batch.IDs) {
+    stmt, err := tx.Prepare("INSERT OR IGNORE INTO dedup_ids (period, id) VALUES (?, ?)")
+    if err != nil { tx.Rollback(); return err }
+    for id := range(set.IDs) {
+      if _, err := stmt.Exec(set.Period, id); err != nil {
+        stmt.Close()
+        tx.Rollback()
+        return err
+      }
+    }
+    stmt.Close()
+  }
+  return tx.Commit()
+}
+
+func (s *sqlite_storage) Close() error {
+  return s.db.Close()
+}
+
+// Dev tool : run an SQL query against the SQLite backend and print the rows
+func run_query(query string) error {
+  backend, ok := STORAGE.(*sqlite_storage)
+  if !ok {
+    return fmt.Errorf("SQL queries need the sqlite storage backend")
+  }
+  rows, err := backend.db.Query(query)
+  if err != nil { return err }
+  defer rows.Close()
+  cols, err := rows.Columns()
+  if err != nil { return err }
+  vals := make([]interface{}, len(cols))
+  ptrs := make([]interface{}, len(cols))
+  for i := range(vals) { ptrs[i] = &vals[i] }
+  for rows.Next() {
+    if err := rows.Scan(ptrs...); err != nil { return err }
+    for i, v := range(vals) {
+      if i > 0 { fmt.Print("\t") }
+      if b, ok := v.([]byte); ok { v = string(b) }
+      fmt.Print(v)
+    }
+    fmt.Println()
+  }
+  return rows.Err()
+}
@@ -1,23 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
-	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"fmt"
-	"strconv"
 	"strings"
 	"github.com/oschwald/geoip2-golang"
+	"github.com/freenas/usage-collector/aggregator"
 )
 
 // Global vars
@@ -31,11 +31,20 @@ var DAILYFILE_SCALE string
 var DAILYFILE_INTERNAL string
 var MONTHLYFILE string
 
+// Period names the current files belong to ("2006-01-02" / "2006-01")
+var DAILYPERIOD string
+var MONTHLYPERIOD string
+
 // Create our mutex we use to prevent race conditions when updating
-// counters
-var wlock sync.Mutex
+// counters. Submissions hold the read lock, anything that reads or swaps
+// all of the counters at once holds the write lock
+var wlock sync.RWMutex
 var slock sync.Mutex
 var ilock sync.Mutex
+var geolock sync.RWMutex
+
+// Currently loaded GeoIP database
+var GEODB *geoip2.Reader
 
 // Locks for our specific file writers
 //var monthlock sync.Mutex
@@ -43,39 +52,47 @@ var ilock sync.Mutex
 //var scalelock sync.Mutex
 //var corelock sync.Mutex
 
-// Counter for number of increments before a write
-var WCOUNTER = 0
-
-type output_json struct{
-	Syscount uint  `json:"systems"`
-	Country map[string]float64 `json:"country"`
-	Capacity float64 `json:"total_capacity_gb"`
-	Disks uint64 `json:"total_disks"`
-	Stats map[string]interface{} `json:"stats"`
-
-}
-var OUT output_json
-var OUT_CORE output_json
-var OUT_ENTERPRISE output_json
-var OUT_SCALE output_json
-var OUT_INTERNAL output_json
-var OUT_COUNT map[string]bool
-var OUT_MONTH output_json
-var OUT_COUNT_MONTH map[string]bool
-
-func convert_to_gigabytes(convert int) int {
-	return (convert / 1024 / 1024 / 1024)
+// Submissions counted since the last flush, updated atomically under
+// wlock.RLock and plainly under wlock.Lock
+var WCOUNTER int64
+
+// Background workers watch STOP and report to WORKERS when they exit.
+// The one-off jobs started by a rollover (render, retention) are counted
+// too, so shutdown waits for them to finish writing.
+var STOP = make(chan struct{})
+var WORKERS sync.WaitGroup
+
+// Stats files are the aggregator's output
+type output_json = aggregator.Output
+
+// Daily and monthly counters
+var AGGREGATOR *aggregator.Sharded
+
+// Why the last rollover couldn't flush the closing period, nil once one
+// has. The old period keeps counting until rollover_loop retries it.
+var ROLLOVER_ERR error
+
+// Open (or re-open) the GeoIP database, swapping it in for the old one
+func load_geoip() error {
+  db, err := geoip2.Open(CONFIG.GeoIPFile)
+  if err != nil { return err }
+  geolock.Lock()
+  old := GEODB
+  GEODB = db
+  geolock.Unlock()
+  if old != nil { old.Close() }
+  return nil
 }
 
 // Where is this request coming from?
 func get_location(clientip string) string {
   //log.Println("Checking IP: " + clientip)
-  db, err := geoip2.Open("/var/db/GeoLite2-Country.mmdb")
-  if err != nil { log.Fatal(err) }
-  defer db.Close()
+  geolock.RLock()
+  defer geolock.RUnlock()
+  if GEODB == nil { return "" }
 
   ip := net.ParseIP(clientip)
-  record, err := db.Country(ip)
+  record, err := GEODB.Country(ip)
   if err != nil { return "" }
   return record.Country.IsoCode
 }
@@ -83,6 +100,8 @@ func get_location(clientip string) string {
 // Getting a new submission
 func submit(rw http.ResponseWriter, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
+	// Keep numbers as json.Number so large byte counts stay exact
+	decoder.UseNumber()
 
 	// Decode the POST data json struct
 	var s map[string]interface{}
@@ -100,601 +119,462 @@ func submit(rw http.ResponseWriter, req *http.Request) {
 	isocode := get_location(ip)
 	//fmt.Println("IP Address:", ip)
 
-	// Check if the daily file needs to roll over
-	// Do this all within a locked mutex
-	slock.Lock()
-	get_daily_filename()
-	// Unlock the mutex now
-	slock.Unlock()
-
-	// Every 100 updates, we update the JSON file on disk
-	wlock.Lock()
-	if WCOUNTER >= 100 {
-		//log.Println("Flushing to disk")
-
-		flush_json_to_disk()
-		WCOUNTER = 0
-	} else {
-		WCOUNTER++
+	// Check if the daily file needs to roll over. Only take the exclusive
+	// locks when it does, a rollover flushes the counters too. A failed
+	// one is left to rollover_loop to retry rather than every submission.
+	wlock.RLock()
+	rollover := period_now().Format("2006-01-02") != DAILYPERIOD && ROLLOVER_ERR == nil
+	wlock.RUnlock()
+	if rollover {
+		slock.Lock()
+		wlock.Lock()
+		get_daily_filename()
+		wlock.Unlock()
+		slock.Unlock()
 	}
-	//log.Println(OUT)
 
-	// Do things with the data
-	parseInput(s, isocode, ip)
-	wlock.Unlock()
+	count, threshold := count_submission(s, ip, isocode)
+
+	// Every FlushThreshold updates, we update the JSON file on disk
+	if count >= threshold {
+		wlock.Lock()
+		// Someone else may have flushed in the meantime
+		if WCOUNTER >= threshold {
+			if err := flush_json_to_disk(); err == nil {
+				WCOUNTER = 0
+			}
+		}
+		wlock.Unlock()
+	}
+}
+
+// Count one submission. Submissions only need the read side of wlock: the
+// aggregator's shards count them in parallel, flushes and rollovers lock
+// them out. A submission the aggregator panics on is logged and dropped,
+// with the lock released so later flushes don't wait on it forever.
+func count_submission(s map[string]interface{}, ip string, isocode string) (count int64, threshold int64) {
+	wlock.RLock()
+	defer wlock.RUnlock()
+	threshold = int64(CONFIG.FlushThreshold)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Failed counting submission:", r)
+		}
+	}()
+
+	// Keep the submission as it arrived so it can be counted again later
+	if CONFIG.ArchiveRaw {
+		if err := archive_submission(s, ip, isocode, time.Now()); err != nil {
+			log.Println("Failed archiving submission:", err)
+		}
+	}
 
+	// Do things with the data
+	if err := AGGREGATOR.Add(s, aggregator.Meta{Country: isocode, IP: ip}); err != nil {
+		log.Println(err)
+	} else if CONFIG.Anomaly.Enabled {
+		platform, _ := s["platform"].(string)
+		VOLUME.record(period_now(), aggregator.Segment(platform, ip), isocode)
+	}
+	count = atomic.AddInt64(&WCOUNTER, 1)
+	return count, threshold
 }
 
 func readjson( path string ) {
    jsfile, err := os.Open(path)
    if err == nil {
-    _data, _ := ioutil.ReadAll(jsfile);
     var s map[string]interface{}
 
-    json.Unmarshal(_data, &s)
+    decoder := json.NewDecoder(jsfile)
+    decoder.UseNumber()
+    decoder.Decode(&s)
     jsfile.Close()
     //fmt.Println(_data)
     //fmt.Println("Input:", s)
-    parseInput(s,"LOCALTEST", "")
+    if err := AGGREGATOR.Add(s, aggregator.Meta{Country: "LOCALTEST"}); err != nil {
+      log.Println(err)
+    }
     //raw, _ := json.MarshalIndent(OUT,"","  ")
     //fmt.Println( "Output:", OUT)
     //fmt.Println( string(raw) )
   }
 }
 
-func addToJsonObject(OUTMAP output_json, geolocation string, inputs map[string]interface{} ) output_json {
-
-    _, install := inputs["install"]
-    _, firstboot := inputs["firstboot"]
-
-    if ( ! install && ! firstboot ) {
-      // increment the system count - Only if not a first-boot / installer scenario
-      OUTMAP.Syscount = OUTMAP.Syscount+1
-      if len(geolocation)>0 {
-        cnum := OUTMAP.Country[geolocation]
-        OUTMAP.Country[geolocation] = cnum+1
-      }
-    }
-
-    //Now start loading all the input fields and incrementing the counters in the map
-    for key := range(inputs) {
-      if key=="system_hash" || key=="usage_version" { continue }
-      OUTMAP.Stats = addToMap( OUTMAP.Stats, key, inputs[key] )
-    }
-    OUTMAP = get_storage_totals(OUTMAP, inputs);
-    return OUTMAP
-}
-
-func privateIP(ip string) (bool, error) {
-    var err error
-    private := false
-    IP := net.ParseIP(ip)
-    if IP == nil {
-        err = errors.New("Invalid IP")
-    } else {
-        _, private24BitBlock, _ := net.ParseCIDR("10.0.0.0/8")
-        _, private20BitBlock, _ := net.ParseCIDR("172.16.0.0/12")
-        _, private16BitBlock, _ := net.ParseCIDR("192.168.0.0/16")
-        private = private24BitBlock.Contains(IP) || private20BitBlock.Contains(IP) || private16BitBlock.Contains(IP)
-    }
-    return private, err
-}
-
-func parseInput(inputs map[string]interface{}, geolocation string, ip string) {
-  //First verify that the system was not already counted
-  id := ""
-  if tmp, ok := inputs["system_hash"] ; ok {
-    id = tmp.(string)
-  }
-  if ( id == "" ) {
-    fmt.Println("Empty ID:, %v", inputs);
-    return;
-  }
-  // DAILY STATS OBJECT
-
-  // Convert ID into ID + IP
-  t := time.Now()
-  id = id + "-" + ip + "-" + t.String()
-
-  // Init our platform string
-  platform := "unknown"
-
-
-  // Locate the platform key
-  platform = fmt.Sprintf("%v", inputs["platform"])
-
-
-  // Add to the combined JSON object
-  OUT_COUNT[id] = true
-  OUT = addToJsonObject(OUT, geolocation, inputs)
-
-  // If this is coming in via an internal IP address, lets toss those into their own file
-  isPrivate, _ := privateIP(ip)
-  if ( isPrivate || ip == "" ) {
-	OUT_INTERNAL = addToJsonObject(OUT_INTERNAL, geolocation, inputs)
-  } else {
-
-      // Add platform specific stats / files
-      switch platform {
-        case "FreeNAS":
-	  OUT_CORE = addToJsonObject(OUT_CORE, geolocation, inputs)
-        case "TrueNAS":
-	  OUT_ENTERPRISE = addToJsonObject(OUT_ENTERPRISE, geolocation, inputs)
-        case "TrueNAS-CORE":
-	  OUT_CORE = addToJsonObject(OUT_CORE, geolocation, inputs)
-        case "TrueNAS-Enterprise":
-	  OUT_ENTERPRISE = addToJsonObject(OUT_ENTERPRISE, geolocation, inputs)
-        case "TrueNAS-ENTERPRISE":
-	  OUT_ENTERPRISE = addToJsonObject(OUT_ENTERPRISE, geolocation, inputs)
-        case "TrueNAS-SCALE":
-	  OUT_SCALE = addToJsonObject(OUT_SCALE, geolocation, inputs)
-        default:
-	  fmt.Println("Invalid Platform ID:, %v", platform);
-      }
-
-  }
-
-  // MONTHLY STATS OBJECT
-  if _, ok:= OUT_COUNT_MONTH[id] ; !ok {
-    OUT_COUNT_MONTH[id] = true
-    //increment the system count
-    OUT_MONTH.Syscount = OUT_MONTH.Syscount+1
-    if len(geolocation)>0 {
-      cnum := OUT_MONTH.Country[geolocation]
-      OUT_MONTH.Country[geolocation] = cnum+1
-    }
-    //Now start loading all the input fields and incrementing the counters in the map
-    for key := range(inputs) {
-      if key=="system_hash" || key=="usage_version" { continue }
-      OUT_MONTH.Stats = addToMap( OUT_MONTH.Stats, key, inputs[key] )
-    }
-    OUT_MONTH = get_storage_totals(OUT_MONTH, inputs);
-  }
-
-}
-
-func get_storage_totals( OutS output_json, IN map[string]interface{}) output_json {
-  // pools -> [] -> (capacity/disks)
-  if list, ok := IN["pools"] ; ok {
-
-    for _, obj := range(list.([]interface{})) {
-      if val, ok2 := obj.(map[string]interface{})["capacity"] ; ok2 {
-        OutS.Capacity += float64( convert_to_gigabytes( int( val.(float64) ) ) );
-      }
-      if val, ok2 := obj.(map[string]interface{})["disks"] ; ok2 {
-        OutS.Disks += uint64(val.(float64));
-      }
-    }
-  }
-  return OutS
-}
-
-func addToMap( M map[string]interface{}, key string, Val interface{}) map[string]interface{} {
-  //fmt.Println("Add To Map", key, Val)
-  v := reflect.ValueOf(Val)
-
-  if M == nil {
-    M = make(map[string]interface{})
-  }
-  MF := make(map[string]interface{})
-  tmp, ok := M[key]
-  if ok { MF = tmp.(map[string]interface{}) }
-
-  switch v.Kind(){
-  case reflect.Invalid:
-      return M
-
-  case reflect.Map:
-	//fmt.Println("Map:", Val)
-        sm := Val.(map[string]interface{})
-	for field := range(sm){
-	  MF = addToMap(MF, field, sm[field])
-        }
-
-  case reflect.Slice:
-	M = addSliceToMap(M, key, Val.([]interface{}) );
-        return M
-
-  case reflect.Bool:
-	MF = addBoolToMap(MF, Val.(bool))
-  case reflect.String:
-	//fmt.Println("String",Val)
-	MF = addStringToMap(MF, Val.(string))
-
-  case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64:
-	//fmt.Println("INT",Val)
-	MF = addNumberToMap(MF, Val.(int), key)
-
-  case reflect.Uint, reflect.Uint8, reflect.Uint32, reflect.Uint64:
-	//fmt.Println("UINT",Val)
-	MF = addNumberToMap(MF, int( Val.(uint) ), key )
-
-  case reflect.Float32:
-	//fmt.Println("Float32",Val)
-	MF = addNumberToMap(MF, int( Val.(float32)  ), key )
-
-  case reflect.Float64:
-	//fmt.Println("Float64",Val)
-	MF = addNumberToMap(MF, int( Val.(float64)  ), key )
-
-  case reflect.Complex64:
-	//fmt.Println("Complex64",Val)
-	//MF = addNumberToMap(MF, int( Val.(complex64)  ), key )
-
-  case reflect.Complex128:
-	//fmt.Println("Complex128",Val)
-	//MF = addNumberToMap(MF, int( Val.(complex128)  ), key )
-
-  default:
-	fmt.Println("Default",Val, v.Kind())
-  }
-  if len(MF) == 0 { fmt.Println("[UNKNOWN]", key, Val) }
-  M[key] = MF
-  return M
-}
-
-func findUniqueKey( M map[string]interface{}) []string {
-  priority := []string{"name","release", "members", "type"}
-  val, ok := M[priority[0]]
-  num := 0
-  for !ok && (num < 3) {
-	num = num+1
-	val, ok = M[priority[num]]
-  }
-  var out []string
-  if !ok {
-    return out
-  } else if (num == 2) {
-    //This is a slice of keys
-    for _, i := range(val.([]interface{})) { out = append(out, i.(string)) }
-
-  } else if (num>=0) {
-	out = append(out, val.(string))
-
-  }
-  return out
-}
-
-func addSliceToMap(M map[string]interface{}, key string, Val []interface{}) map[string]interface{} {
-  //Create the optional output map
-  MF := make(map[string]interface{})
-  tmp, ok := M[key]
-  if ok { MF = tmp.(map[string]interface{}) }
-
-  for _, subval := range( Val ) {
-    //fmt.Println("subval:", subval)
-    _type := reflect.ValueOf(subval).Kind()
-    if _type == reflect.Map {
-      //List of maps - Need to create a sub-map and add them in there
-      submap := subval.(map[string]interface{})
-
-      //fmt.Println("submap:", submap)
-      keys := findUniqueKey(submap)
-      if len(keys) == 0 {
-        //fmt.Println("No Unique Keys", key, submap)
-        M = addToMap(M, key, submap)
-      } else {
-        //fmt.Println("Got Unique Keys", key, keys, submap)
-        for _, subKey := range(keys) {
-          MF = addToMap(MF, subKey, submap)
-        }
-      }
-    } else {
-      //Just a list of strings/numbers/etc - add them directly to the output map
-      M = addToMap(M, key, subval)
-    }
-  } //end loop over elements
-  if len(MF) > 0 { M[key] = MF }
-  return M;
-}
-
-func addNumberToMap(M map[string]interface{}, val int, key string) map[string]interface{} {
-  //fmt.Println("Add Number to Map:", val)
-  //Check if this number needs to be converted to GB first
-  name := strconv.Itoa(val)
-  if key=="memory" || key=="capacity" || key=="total_size" || key=="filesize" ||
-     key=="data_without_backup_size" || key=="cloudsync" || key=="rsync" ||
-     key=="zfs_replication" || key=="rsynctask" || strings.HasPrefix(key, "usedby") {
-    val = convert_to_gigabytes(val);
-    if ( val > 10000 ) {
-      val = round_to_thousand(val);
-    } else if ( val > 1000 ) {
-      val = round_to_hundred(val);
-    } else if ( val > 100 ) {
-      val = round_to_ten(val);
-    }
-    name = strconv.Itoa(val)+"GB"
-  }
-  if key=="snapshots" || key=="datasets" {
-    if ( val > 10000 ) {
-      val = round_to_thousand(val);
-    } else if ( val > 1000 ) {
-      val = round_to_hundred(val);
-    } else if ( val > 100 ) {
-      val = round_to_ten(val);
-    }
-    name = strconv.Itoa(val)
-  }
-  cnum := 0.0
-  if num, err := M[name] ; err { cnum = num.(float64) }
-  M[name] = cnum+1
-  return M
-}
-
-func round_to_thousand(val int) int {
-  return int(math.Round( float64(val)/1000) * 1000)
-}
-
-func round_to_hundred(val int) int {
-  return int(math.Round( float64(val)/100 ) * 100)
-}
-
-func round_to_ten(val int) int {
-  return int(math.Round( float64(val)/10 ) * 10)
-}
-
-func addStringToMap(M map[string]interface{}, name string) map[string]interface{} {
-  //fmt.Println("Add String to Map:", name)
-  cnum := 0.0
-  if num, err := M[name] ; err { cnum = num.(float64) }
-  M[name] = cnum+1
-  return M
-}
-
-func addBoolToMap(M map[string]interface{}, val bool) map[string]interface{} {
-  //fmt.Println("Add String to Map:", name)
-  name := "true"
-  if !val { name = "false" }
-  cnum := 0.0
-  if num, err := M[name] ; err { cnum = num.(float64) }
-  M[name] = cnum+1
-  return M
-}
-
-// Clear out the JSON structure counters
-func zero_out_stats() {
-  OUT = output_json{}
-  if OUT.Country == nil {
-    OUT.Country = make(map[string]float64)
-  }
-  OUT_COUNT = make(map[string]bool)
-
-  OUT_CORE = output_json{}
-  if OUT_CORE.Country == nil {
-    OUT_CORE.Country = make(map[string]float64)
-  }
-
-  OUT_ENTERPRISE = output_json{}
-  if OUT_ENTERPRISE.Country == nil {
-    OUT_ENTERPRISE.Country = make(map[string]float64)
-  }
-
-  OUT_SCALE = output_json{}
-  if OUT_SCALE.Country == nil {
-    OUT_SCALE.Country = make(map[string]float64)
-  }
-
-  OUT_INTERNAL = output_json{}
-  if OUT_INTERNAL.Country == nil {
-    OUT_INTERNAL.Country = make(map[string]float64)
-  }
+// Get the latest daily file to store data
+func get_daily_filename() error {
+  return set_period(period_now())
 }
 
-func zero_out_monthly_stats() {
-  OUT_MONTH = output_json{}
-  if OUT_MONTH.Country == nil {
-    OUT_MONTH.Country = make(map[string]float64)
-  }
-  OUT_COUNT_MONTH = make(map[string]bool)
+// Switch the in-memory counters over to the period containing t,
+// closing out the previous day / month if it has changed. A reload that
+// changes the timezone can move the date back: then nothing is closed,
+// and the counters stored for the earlier day / month are loaded again.
+// If the counters can't be flushed first nothing changes: the old period
+// and its counters stay in place and the error is returned.
+func set_period(t time.Time) error {
+  return switch_period(t, false)
 }
 
-// Get the latest daily file to store data
-func get_daily_filename() {
-  t := time.Now()
-
+// set_period, but with force the current day is closed and opened again
+// even if t is still in it
+func switch_period(t time.Time, force bool) error {
   newfile := SDIR + "/" + t.Format("2006-01-02") + ".json"
   newfile_core := SDIR + "/" + t.Format("2006-01-02") + "-CORE.json"
   newfile_enterprise := SDIR + "/" + t.Format("2006-01-02") + "-ENTERPRISE.json"
   newfile_scale := SDIR + "/" + t.Format("2006-01-02") + "-SCALE.json"
   newfile_internal := SDIR + "/" + t.Format("2006-01-02") + "-INTERNAL.json"
-  if newfile != DAILYFILE {
+  closed_month := ""
+  // Switching while running, rather than picking the first period at startup
+  running := DAILYFILE != ""
+  forward := force || t.Format("2006-01-02") > DAILYPERIOD
+  if newfile != DAILYFILE || force {
     // Flush previous data to disk
-    if DAILYFILE != "" {
-      flush_json_to_disk()
+    if running {
+      batch, err := flush_batch()
+      ROLLOVER_ERR = err
+      if err != nil {
+        // Resetting now would lose the period, and it isn't complete
+        log.Println("Failed flushing before rollover, keeping", DAILYPERIOD + ":", err)
+        return err
+      }
+      WCOUNTER = 0
+      if forward && MONTHLYPERIOD != t.Format("2006-01") {
+        // The monthly file was flushed above too, close it after the day
+        closed_month = MONTHLYPERIOD
+      }
+      if forward {
+        write_closed_marker(DAILYPERIOD, SEGMENTS)
+        queue_period_webhooks(DAILYPERIOD, batch)
+      }
+      if closed_month != "" {
+        write_closed_marker(closed_month, []string{""})
+        queue_period_webhooks(closed_month, batch)
+      }
+      if forward && CONFIG.RenderDir != "" {
+        render_after_rollover(CONFIG.RenderDir)
+      }
+      if forward && CONFIG.Retention.enabled() {
+        retention_after_rollover(CONFIG.Retention)
+      }
     }
     // Timestamp has changed, lets reset our in-memory json counters structure
-    zero_out_stats()
+    AGGREGATOR.ResetDay()
     // Set new DAILYFILE
     DAILYFILE = newfile
     DAILYFILE_CORE = newfile_core
     DAILYFILE_ENTERPRISE = newfile_enterprise
     DAILYFILE_SCALE = newfile_scale
     DAILYFILE_INTERNAL = newfile_internal
+    DAILYPERIOD = t.Format("2006-01-02")
 
-    // Update the latest.json symlink
-    os.Remove(SDIR + "/latest.json")
-    os.Symlink(DAILYFILE, SDIR+"/latest.json")
+    // Only the file layout has latest*.json symlinks
+    if _, ok := STORAGE.(*file_storage); ok {
+      // Update the latest.json symlink
+      os.Remove(SDIR + "/latest.json")
+      os.Symlink(DAILYFILE, SDIR+"/latest.json")
 
-    os.Remove(SDIR + "/latest-CORE.json")
-    os.Symlink(DAILYFILE_CORE, SDIR+"/latest-CORE.json")
+      os.Remove(SDIR + "/latest-CORE.json")
+      os.Symlink(DAILYFILE_CORE, SDIR+"/latest-CORE.json")
 
-    os.Remove(SDIR + "/latest-ENTERPRISE.json")
-    os.Symlink(DAILYFILE_ENTERPRISE, SDIR+"/latest-ENTERPRISE.json")
+      os.Remove(SDIR + "/latest-ENTERPRISE.json")
+      os.Symlink(DAILYFILE_ENTERPRISE, SDIR+"/latest-ENTERPRISE.json")
 
-    os.Remove(SDIR + "/latest-SCALE.json")
-    os.Symlink(DAILYFILE_SCALE, SDIR+"/latest-SCALE.json")
+      os.Remove(SDIR + "/latest-SCALE.json")
+      os.Symlink(DAILYFILE_SCALE, SDIR+"/latest-SCALE.json")
 
-    os.Remove(SDIR + "/latest-INTERNAL.json")
-    os.Symlink(DAILYFILE_INTERNAL, SDIR+"/latest-INTERNAL.json")
+      os.Remove(SDIR + "/latest-INTERNAL.json")
+      os.Symlink(DAILYFILE_INTERNAL, SDIR+"/latest-INTERNAL.json")
+    }
+    // Anything already stored for the new day (going back to it, or
+    // forward again after that) is counted on from, not overwritten
+    if running {
+      if !forward { reopen_period(DAILYPERIOD) }
+      if err := load_day_counters(); err != nil {
+        log.Println("Failed loading daily stats:", err)
+      }
+    }
   }
 
   //Now see if we need to rotate the monthly id file as well
   newfile = SDIR+"/"+t.Format("2006-01")+".json"
   if newfile != MONTHLYFILE {
-    zero_out_monthly_stats()
+    AGGREGATOR.ResetMonth()
+    running := MONTHLYFILE != ""
     MONTHLYFILE = newfile
-    os.Remove(SDIR + "/latest-month.json")
-    os.Symlink(MONTHLYFILE, SDIR+"/latest-month.json")
+    MONTHLYPERIOD = t.Format("2006-01")
+    if running {
+      if !forward { reopen_period(MONTHLYPERIOD) }
+      if err := load_month_counters(); err != nil {
+        log.Println("Failed loading monthly stats:", err)
+      }
+    }
+    if _, ok := STORAGE.(*file_storage); ok {
+      os.Remove(SDIR + "/latest-month.json")
+      os.Symlink(MONTHLYFILE, SDIR+"/latest-month.json")
+    }
   }
-
+  return nil
 }
 
-// Load the daily file into memory
-func load_daily_file() {
-  //Verify that the output directory exists
+// Make sure the output directory exists
+func check_output_dir() {
   if _, err := os.Stat(SDIR); os.IsNotExist(err) {
     err = os.MkdirAll(SDIR, 0755)
     if err != nil { fmt.Println("[ERROR] Could not create output directory:", SDIR); os.Exit(1) }
   }
-  // No file yet? Lets clear out the struct
-  if _, err := os.Stat(DAILYFILE); os.IsNotExist(err) {
-    zero_out_stats()
-    return
-  }
-
-  // Load the file into memory
-  dat, err := ioutil.ReadFile(DAILYFILE)
-  if err != nil {
-    log.Println(err)
-    log.Fatal("Failed loading daily file: " + DAILYFILE)
-  }
-  if err := json.Unmarshal(dat, &OUT); err != nil {
-    log.Println(err)
-    log.Fatal("Failed unmarshal of JSON in DAILYFILE:")
-  }
-  // Now load the ID file
-  dat, err = ioutil.ReadFile(DAILYFILE+".id")
-  if err == nil {
-    json.Unmarshal(dat, &OUT_COUNT);
-  }
+}
 
-  // Load the CORE file into memory
-  dat, err = ioutil.ReadFile(DAILYFILE_CORE)
-  if err != nil {
-    log.Println(err)
-    log.Println("Failed loading daily file: " + DAILYFILE_CORE)
-  }
-  if err = json.Unmarshal(dat, &OUT_CORE); err != nil {
+// Load the daily file into memory
+func load_daily_file() {
+  //Verify that the output directory exists
+  check_output_dir()
+  if err := load_day_counters(); err != nil {
     log.Println(err)
-    log.Println("Failed unmarshal of JSON in DAILYFILE_CORE:")
+    log.Fatal("Failed loading daily stats: " + STORAGE.Location(DAILYPERIOD, ""))
   }
+}
 
-  // Load the ENTERPRISE file into memory
-  dat, err = ioutil.ReadFile(DAILYFILE_ENTERPRISE)
+// Replace the daily counters with those stored for DAILYPERIOD, empty if
+// nothing is stored yet
+func load_day_counters() error {
+  out, found, err := STORAGE.LoadAggregate(DAILYPERIOD, "")
   if err != nil {
-    log.Println(err)
-    log.Println("Failed loading daily file: " + DAILYFILE_ENTERPRISE)
-  }
-  if err = json.Unmarshal(dat, &OUT_ENTERPRISE); err != nil {
-    log.Println(err)
-    log.Println("Failed unmarshal of JSON in DAILYFILE_ENTERPRISE:")
+    AGGREGATOR.ResetDay()
+    return err
+  }
+  if !found {
+    AGGREGATOR.ResetDay()
+    return nil
+  }
+  daily := map[string]output_json{"": out}
+
+  // Now load the ID set
+  ids, err := STORAGE.LoadIDs(DAILYPERIOD)
+  if err != nil { ids = nil }
+
+  // Load the per-segment stats into memory
+  for _, segment := range(SEGMENTS[1:]) {
+    out, found, err := STORAGE.LoadAggregate(DAILYPERIOD, segment)
+    if err != nil {
+      log.Println("Failed loading daily stats:", STORAGE.Location(DAILYPERIOD, segment) + ":", err)
+      continue
+    } else if !found {
+      continue
+    }
+    daily[segment] = out
   }
+  AGGREGATOR.LoadDay(daily, ids)
+  return nil
+}
 
-  // Load the SCALE file into memory
-  dat, err = ioutil.ReadFile(DAILYFILE_SCALE)
-  if err != nil {
-    log.Println(err)
-    log.Println("Failed loading daily file: " + DAILYFILE_SCALE)
-  }
-  if err = json.Unmarshal(dat, &OUT_SCALE); err != nil {
+func load_monthly_file() {
+  //Verify that the output directory exists
+  check_output_dir()
+  if err := load_month_counters(); err != nil {
     log.Println(err)
-    log.Println("Failed unmarshal of JSON in DAILYFILE_SCALE:")
+    log.Fatal("Failed loading monthly stats: " + STORAGE.Location(MONTHLYPERIOD, ""))
   }
+}
 
-  // Load the INTERNAL file into memory
-  dat, err = ioutil.ReadFile(DAILYFILE_INTERNAL)
+// Replace the monthly counters with those stored for MONTHLYPERIOD
+func load_month_counters() error {
+  out, found, err := STORAGE.LoadAggregate(MONTHLYPERIOD, "")
   if err != nil {
-    log.Println(err)
-    log.Println("Failed loading daily file: " + DAILYFILE_INTERNAL)
-  }
-  if err = json.Unmarshal(dat, &OUT_INTERNAL); err != nil {
-    log.Println(err)
-    log.Println("Failed unmarshal of JSON in DAILYFILE_INTERNAL:")
-  }
-
-
+    AGGREGATOR.ResetMonth()
+    return err
+  }
+  if !found {
+    AGGREGATOR.ResetMonth()
+    return nil
+  }
+  // Now load the ID set
+  ids, err := STORAGE.LoadIDs(MONTHLYPERIOD)
+  if err != nil { ids = nil }
+  AGGREGATOR.LoadMonth(out, ids)
+  return nil
 }
 
-func load_monthly_file() {
-  //Verify that the output directory exists
-  if _, err := os.Stat(SDIR); os.IsNotExist(err) {
-    err = os.MkdirAll(SDIR, 0755)
-    if err != nil { fmt.Println("[ERROR] Could not create output directory:", SDIR); os.Exit(1) }
+// Write a file via a temp file + rename so readers never see a partial file
+func write_file_atomic(path string, data []byte) error {
+  tmp := path + ".tmp"
+  if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+    return err
   }
+  return os.Rename(tmp, path)
+}
 
-  // No file yet? Lets clear out the struct
-  if _, err := os.Stat(MONTHLYFILE); os.IsNotExist(err) {
-    zero_out_monthly_stats()
-    return
-  }
+// Caller must hold wlock (or be the only goroutine touching the counters)
+func flush_json_to_disk() error {
+  _, err := flush_batch()
+  return err
+}
 
-  // Load the file into memory
-  dat, err := ioutil.ReadFile(MONTHLYFILE)
-  if err != nil {
-    log.Println(err)
-    log.Fatal("Failed loading daily file: " + DAILYFILE)
+// Flush the counters, returning the batch that was written. Only failing
+// to save the stats is an error: the flat copies are written again on the
+// next flush.
+func flush_batch() (storage_batch, error) {
+  // Everything goes out as one batch so the backend can make it atomic
+  batch := current_batch()
+  if err := STORAGE.Save(batch); err != nil {
+    return batch, err
   }
-  if err := json.Unmarshal(dat, &OUT_MONTH); err != nil {
-    log.Println(err)
-    log.Fatal("Failed unmarshal of JSON in DAILYFILE:")
+  if err := write_flat_outputs(batch); err != nil {
+    log.Println("Failed writing flat stats:", err)
   }
-  // Now load the ID file
+  return batch, nil
+}
 
-  dat, err = ioutil.ReadFile(MONTHLYFILE+".id")
-  if err == nil {
-    json.Unmarshal(dat, &OUT_COUNT_MONTH);
+// Flush dirty counters on a timer so quiet periods still reach disk
+func flush_loop() {
+  defer WORKERS.Done()
+  for {
+    // Re-read the interval every time so a reload can change it
+    wlock.RLock()
+    interval := time.Duration(CONFIG.FlushInterval) * time.Second
+    wlock.RUnlock()
+    if interval <= 0 { interval = time.Minute }
+    timer := time.NewTimer(interval)
+    select {
+    case <-STOP:
+      timer.Stop()
+      return
+    case <-timer.C:
+    }
+    // Same lock order as a rollover, so we never flush concurrently with one
+    slock.Lock()
+    wlock.Lock()
+    if WCOUNTER > 0 && CONFIG.FlushInterval > 0 {
+      if err := flush_json_to_disk() ; err == nil {
+        WCOUNTER = 0
+      }
+    }
+    wlock.Unlock()
+    slock.Unlock()
   }
 }
 
-func flush_json_to_disk() {
-  //fmt.Println("Writing to Files:", DAILYFILE, DAILYFILE_CORE, DAILYFILE_ENTERPRISE, DAILYFILE_SCALE, DAILYFILE_INTERNAL, MONTHLYFILE);
-  file, _ := json.MarshalIndent(OUT, "", " ")
-  _ = ioutil.WriteFile(DAILYFILE, file, 0644)
-  file, _ = json.MarshalIndent(OUT_COUNT, "", " ")
-  _ = ioutil.WriteFile(DAILYFILE+".id", file, 0644)
-
-  file, _ = json.MarshalIndent(OUT_CORE, "", " ")
-  _ = ioutil.WriteFile(DAILYFILE_CORE, file, 0644)
-
-  file, _ = json.MarshalIndent(OUT_ENTERPRISE, "", " ")
-  _ = ioutil.WriteFile(DAILYFILE_ENTERPRISE, file, 0644)
-
-  file, _ = json.MarshalIndent(OUT_SCALE, "", " ")
-  _ = ioutil.WriteFile(DAILYFILE_SCALE, file, 0644)
+// Stop taking requests, let in-flight work finish and write the final state
+func shutdown(srv *http.Server) int {
+  ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+  defer cancel()
+  if err := srv.Shutdown(ctx); err != nil {
+    log.Println("Failed draining HTTP requests:", err)
+  }
+  // Tell the background workers to stop and wait for them
+  close(STOP)
+  WORKERS.Wait()
+
+  slock.Lock()
+  wlock.Lock()
+  defer wlock.Unlock()
+  defer slock.Unlock()
+  close_archive()
+  if err := VOLUME.flush(anomaly_settings(CONFIG.Anomaly)); err != nil {
+    log.Println("Failed saving submission volumes:", err)
+  }
+  if err := flush_json_to_disk(); err != nil {
+    log.Println("Final flush failed:", err)
+    return 1
+  }
+  return 0
+}
 
-  file, _ = json.MarshalIndent(OUT_INTERNAL, "", " ")
-  _ = ioutil.WriteFile(DAILYFILE_INTERNAL, file, 0644)
+// Subcommands, run as "usage <command> [args]"
+var SUBCOMMANDS = map[string]func([]string) error{
+  "query": query_cmd,
+  "export": export_cmd,
+  "merge": merge_cmd,
+  "diff": diff_cmd,
+  "render": render_cmd,
+  "reaggregate": reaggregate_cmd,
+  "bench": bench_cmd,
+  "simulate": simulate_cmd,
+  "retention": retention_cmd,
+}
 
-  file, _ = json.MarshalIndent(OUT_MONTH, "", " ")
-  _ = ioutil.WriteFile(MONTHLYFILE, file, 0644)
-  file, _ = json.MarshalIndent(OUT_COUNT_MONTH, "", " ")
-  _ = ioutil.WriteFile(MONTHLYFILE+".id", file, 0644)
-  //fmt.Println( string(file))
+// query "<SQL>" : run SQL against the sqlite storage backend
+func query_cmd(args []string) error {
+  if len(args) != 1 {
+    return errors.New("Usage: query \"<SQL>\"")
+  }
+  return run_query(args[0])
 }
 
 // Lets do it!
 func main() {
+  if err := load_config(); err != nil {
+    log.Println(err)
+    log.Fatal("Failed loading config file: " + CONFIGFILE)
+  }
+  check_output_dir()
+  var err error
+  if AGGREGATOR, err = aggregator.NewSharded(aggregator_config(), shard_count()); err != nil {
+    log.Fatal(err)
+  }
+  if STORAGE, err = open_storage(); err != nil {
+    log.Fatal(err)
+  }
+  defer STORAGE.Close()
+
+  // Tools that work on the stored stats rather than the live counters
+  if len(os.Args) > 1 {
+    if cmd, ok := SUBCOMMANDS[os.Args[1]] ; ok {
+      if err := cmd(os.Args[2:]); err != nil {
+        STORAGE.Close()
+        log.Fatal(err)
+      }
+      return
+    }
+  }
+
   if len(os.Args) < 2 {
-    // Capture SIGTERM and flush JSON to disk
-    var gracefulStop = make(chan os.Signal)
-    signal.Notify(gracefulStop, syscall.SIGTERM)
-    signal.Notify(gracefulStop, syscall.SIGINT)
-    go func() {
-      sig := <-gracefulStop
-      log.Println("%v", sig)
-      log.Println("Caught Signal. Flushing JSON to disk")
-      flush_json_to_disk()
-      os.Exit(0)
-    }()
+    if err := load_geoip(); err != nil {
+      log.Fatal(err)
+    }
 
     // Read the current files into memory at startup
     get_daily_filename()
     load_daily_file()
     load_monthly_file()
 
+    if CONFIG.Anomaly.Enabled {
+      VOLUME.load(anomaly_settings(CONFIG.Anomaly))
+    }
+
+    // Start the background flusher, the rollover scheduler, the volume
+    // watcher, the webhook sender and the SIGHUP / SIGUSR1 handler
+    WORKERS.Add(5)
+    go flush_loop()
+    go rollover_loop()
+    go anomaly_loop()
+    go webhook_loop()
+    go control_signals()
+
     // Start our HTTP listener
-    http.HandleFunc("/submit", submit)
-    log.Fatal(http.ListenAndServe("127.0.0.1:8082", nil))
+    mux := http.NewServeMux()
+    mux.HandleFunc("/submit", submit)
+    mux.HandleFunc("/admin/", admin)
+    mux.HandleFunc("/stats", read_stats)
+    mux.HandleFunc("/status", read_status)
+    srv := &http.Server{Addr: "127.0.0.1:8082", Handler: mux}
+
+    // Capture SIGTERM and drain / flush JSON to disk
+    var gracefulStop = make(chan os.Signal, 1)
+    signal.Notify(gracefulStop, syscall.SIGTERM, syscall.SIGINT)
+    done := make(chan int)
+    go func() {
+      sig := <-gracefulStop
+      log.Println("Caught Signal:", sig)
+      log.Println("Draining requests and flushing JSON to disk")
+      done <- shutdown(srv)
+    }()
+
+    if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+      log.Fatal(err)
+    }
+    status := <-done
+    STORAGE.Close()
+    os.Exit(status)
 
   } else {
     // Dev Test : Loading a list of files directly from the CLI
@@ -0,0 +1,270 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "os"
+  "sort"
+  "strings"
+  "time"
+)
+
+// Where to tell downstream jobs that a period has closed
+type webhook_config struct{
+  URLs []string `json:"urls"`
+  // Key for the X-Usage-Signature HMAC of each payload (empty sends no signature)
+  Secret string `json:"secret"`
+  // Deliveries given up on after this many attempts (default 10)
+  MaxAttempts int `json:"max_attempts"`
+}
+
+// Totals and file of one segment of a closed period
+type segment_summary struct{
+  Segment string `json:"segment"`
+  Systems uint `json:"systems"`
+  Submissions uint `json:"submissions"`
+  CapacityGB float64 `json:"total_capacity_gb"`
+  CapacityBytes uint64 `json:"total_capacity_bytes"`
+  Disks uint64 `json:"total_disks"`
+  Location string `json:"location"`
+  // SHA-256 of the file, for the file storage backend
+  SHA256 string `json:"sha256,omitempty"`
+  Size int64 `json:"size,omitempty"`
+}
+
+// Payload POSTed to every webhook URL when a day or month closes
+type period_summary struct{
+  Event string `json:"event"`
+  Period string `json:"period"`
+  // "day" or "month"
+  Kind string `json:"kind"`
+  ClosedAt string `json:"closed_at"`
+  Timezone string `json:"timezone"`
+  Segments []segment_summary `json:"segments"`
+}
+
+// One notification waiting in the outbox
+type outbox_entry struct{
+  URL string `json:"url"`
+  Body json.RawMessage `json:"body"`
+  Attempts int `json:"attempts"`
+  NextAttempt time.Time `json:"next_attempt"`
+  LastError string `json:"last_error,omitempty"`
+  // The body still needs the files' checksums (file storage only)
+  Checksum bool `json:"checksum,omitempty"`
+}
+
+// Nudges the sender when something new is in the outbox
+var WEBHOOK_WAKE = make(chan struct{}, 1)
+
+func outbox_dir() string {
+  return SDIR + "/outbox"
+}
+
+// Build the summary of a period from the batch it was just flushed in
+func summarize_period(period string, batch storage_batch) period_summary {
+  summary := period_summary{
+    Event: "period.closed",
+    Period: period,
+    Kind: "day",
+    ClosedAt: time.Now().In(LOCATION).Format(time.RFC3339),
+    Timezone: LOCATION.String(),
+  }
+  if len(period) == 7 { summary.Kind = "month" }
+  for _, agg := range(batch.Aggregates) {
+    if agg.Period != period { continue }
+    out := agg.Stats
+    summary.Segments = append(summary.Segments, segment_summary{
+      Segment: agg.Segment,
+      Systems: out.Syscount,
+      Submissions: out.Submissions,
+      CapacityGB: out.Capacity,
+      CapacityBytes: out.CapacityBytes,
+      Disks: out.Disks,
+      Location: STORAGE.Location(period, agg.Segment),
+    })
+  }
+  return summary
+}
+
+// Put a closed period's summary in the outbox for every webhook URL.
+// Called from set_period under the locks with the batch just flushed, so
+// it only encodes what is already in memory: the files are checksummed
+// by webhook_loop before the first delivery.
+func queue_period_webhooks(period string, batch storage_batch) {
+  if len(CONFIG.Webhooks.URLs) == 0 { return }
+  body, err := json.Marshal(summarize_period(period, batch))
+  if err != nil {
+    log.Println("Failed building webhook summary:", err)
+    return
+  }
+  _, isfile := STORAGE.(*file_storage)
+  if err := os.MkdirAll(outbox_dir(), 0700); err != nil {
+    log.Println("Failed creating webhook outbox:", err)
+    return
+  }
+  for i, url := range(CONFIG.Webhooks.URLs) {
+    entry := outbox_entry{URL: url, Body: body, NextAttempt: time.Now(), Checksum: isfile}
+    file, _ := json.MarshalIndent(entry, "", " ")
+    name := fmt.Sprintf("%s/%d-%s-%d.json", outbox_dir(), time.Now().UnixNano(), period, i)
+    if err := write_file_atomic(name, file); err != nil {
+      log.Println("Failed queueing webhook:", err)
+    }
+  }
+  select {
+    case WEBHOOK_WAKE <- struct{}{}:
+    default:
+  }
+}
+
+// Fill in the SHA-256 and size of each segment's file in a summary
+func checksum_summary(body json.RawMessage) (json.RawMessage, error) {
+  var summary period_summary
+  if err := json.Unmarshal(body, &summary); err != nil { return body, err }
+  for i := range(summary.Segments) {
+    seg := &summary.Segments[i]
+    dat, err := ioutil.ReadFile(seg.Location)
+    if os.IsNotExist(err) {
+      // Compressed by the retention policy in the meantime
+      if dat, err = ioutil.ReadFile(seg.Location + ".gz"); err == nil { seg.Location += ".gz" }
+    }
+    if err == nil {
+      sum := sha256.Sum256(dat)
+      seg.SHA256 = hex.EncodeToString(sum[:])
+      seg.Size = int64(len(dat))
+    }
+  }
+  return json.Marshal(summary)
+}
+
+// Hex HMAC-SHA256 of a payload
+func sign_payload(secret string, body []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write(body)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+var webhook_client = &http.Client{Timeout: 30 * time.Second}
+
+func deliver_webhook(entry outbox_entry, id string, secret string) error {
+  req, err := http.NewRequest("POST", entry.URL, bytes.NewReader(entry.Body))
+  if err != nil { return err }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("X-Usage-Event", "period.closed")
+  // Stays the same across retries, so receivers can drop repeats
+  req.Header.Set("X-Usage-Delivery", id)
+  if secret != "" {
+    req.Header.Set("X-Usage-Signature", "sha256=" + sign_payload(secret, entry.Body))
+  }
+  resp, err := webhook_client.Do(req)
+  if err != nil { return err }
+  io.Copy(ioutil.Discard, resp.Body)
+  resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+    return fmt.Errorf("%s: %s", entry.URL, resp.Status)
+  }
+  return nil
+}
+
+// Wait before the next attempt: 30s doubling up to an hour
+func webhook_backoff(attempts int) time.Duration {
+  wait := 30 * time.Second
+  for i := 1; i < attempts && wait < time.Hour; i++ { wait *= 2 }
+  if wait > time.Hour { wait = time.Hour }
+  return wait
+}
+
+// Try every notification in the outbox that is due, returning when the
+// next one is
+func send_outbox(secret string, max_attempts int) time.Time {
+  next := time.Now().Add(time.Hour)
+  names, err := ioutil.ReadDir(outbox_dir())
+  if err != nil { return next }
+  sort.Slice(names, func(i, j int) bool { return names[i].Name() < names[j].Name() })
+  for _, info := range(names) {
+    // Leave the rest for after a restart rather than hold up shutdown
+    select {
+      case <-STOP:
+        return next
+      default:
+    }
+    name := info.Name()
+    if !info.Mode().IsRegular() || !strings.HasSuffix(name, ".json") { continue }
+    path := outbox_dir() + "/" + name
+    dat, err := ioutil.ReadFile(path)
+    if err != nil { continue }
+    var entry outbox_entry
+    if err := json.Unmarshal(dat, &entry); err != nil {
+      log.Println("Dropping unreadable webhook", path, err)
+      os.Remove(path)
+      continue
+    }
+    if entry.NextAttempt.After(time.Now()) {
+      if entry.NextAttempt.Before(next) { next = entry.NextAttempt }
+      continue
+    }
+    // Once, before the first attempt, so every retry sends the same body
+    if entry.Checksum {
+      if body, err := checksum_summary(entry.Body); err == nil {
+        entry.Body = body
+      } else {
+        log.Println("Failed checksumming webhook", path, err)
+      }
+      entry.Checksum = false
+      file, _ := json.MarshalIndent(entry, "", " ")
+      if err := write_file_atomic(path, file); err != nil { continue }
+    }
+    err = deliver_webhook(entry, strings.TrimSuffix(name, ".json"), secret)
+    if err == nil {
+      os.Remove(path)
+      continue
+    }
+    entry.Attempts++
+    entry.LastError = err.Error()
+    if entry.Attempts >= max_attempts {
+      log.Printf("Giving up on webhook %s after %d attempts: %v\n", entry.URL, entry.Attempts, err)
+      os.MkdirAll(outbox_dir() + "/failed", 0700)
+      file, _ := json.MarshalIndent(entry, "", " ")
+      if write_file_atomic(outbox_dir() + "/failed/" + name, file) == nil { os.Remove(path) }
+      continue
+    }
+    log.Printf("Webhook %s failed (attempt %d): %v\n", entry.URL, entry.Attempts, err)
+    entry.NextAttempt = time.Now().Add(webhook_backoff(entry.Attempts))
+    if entry.NextAttempt.Before(next) { next = entry.NextAttempt }
+    file, _ := json.MarshalIndent(entry, "", " ")
+    write_file_atomic(path, file)
+  }
+  return next
+}
+
+// Deliver the outbox in the background, including whatever was left in
+// it when the collector last stopped
+func webhook_loop() {
+  defer WORKERS.Done()
+  for {
+    wlock.RLock()
+    secret := CONFIG.Webhooks.Secret
+    max_attempts := CONFIG.Webhooks.MaxAttempts
+    wlock.RUnlock()
+    if max_attempts < 1 { max_attempts = 10 }
+    wait := time.Until(send_outbox(secret, max_attempts))
+    if wait < time.Second { wait = time.Second }
+    timer := time.NewTimer(wait)
+    select {
+    case <-STOP:
+      timer.Stop()
+      return
+    case <-WEBHOOK_WAKE:
+      timer.Stop()
+    case <-timer.C:
+    }
+  }
+}